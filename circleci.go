@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultCircleAPI is the base URL for v2 of the CircleCI API
+const defaultCircleAPI = "https://circleci.com/api/v2/"
+
+// maxJobPages bounds the number of pages of jobs we'll fetch for a single
+// workflow so that a misbehaving API can't keep us paging forever.
+const maxJobPages = 100
+
+// circleClient is a minimal client for the parts of the CircleCI v2 API that
+// buildevents needs. It follows next_page_token pagination, which the
+// upstream client library does not support.
+type circleClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func newCircleClient(token string) *circleClient {
+	return &circleClient{
+		baseURL:    defaultCircleAPI,
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// circleWorkflow is a single run of a workflow
+type circleWorkflow struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	PipelineID     string    `json:"pipeline_id"`
+	PipelineNumber int       `json:"pipeline_number"`
+	ProjectSlug    string    `json:"project_slug"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+	StoppedAt      time.Time `json:"stopped_at"`
+}
+
+// circlePipeline is a single run of a project's configuration, which may
+// contain several workflows
+type circlePipeline struct {
+	ID          string    `json:"id"`
+	Number      int       `json:"number"`
+	ProjectSlug string    `json:"project_slug"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	VCS         struct {
+		Branch              string `json:"branch"`
+		Tag                 string `json:"tag"`
+		Revision            string `json:"revision"`
+		OriginRepositoryURL string `json:"origin_repository_url"`
+	} `json:"vcs"`
+	Trigger struct {
+		Type  string `json:"type"`
+		Actor struct {
+			Login string `json:"login"`
+		} `json:"actor"`
+	} `json:"trigger"`
+}
+
+// circleJob is a job instance that exists within a workflow
+type circleJob struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	JobNumber   int        `json:"job_number"`
+	ProjectSlug string     `json:"project_slug"`
+	Status      string     `json:"status"`
+	Type        string     `json:"type"`
+	StartedAt   *time.Time `json:"started_at"`
+	StoppedAt   *time.Time `json:"stopped_at"`
+}
+
+// circleJobDetails is the full description of a single job
+type circleJobDetails struct {
+	Number    int        `json:"number"`
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	QueuedAt  *time.Time `json:"queued_at"`
+	StartedAt *time.Time `json:"started_at"`
+	StoppedAt *time.Time `json:"stopped_at"`
+}
+
+// circleAPIError is returned when the CircleCI API responds with a non-2xx
+// status code.
+type circleAPIError struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the API asked us to wait before trying again,
+	// from the Retry-After header. It is zero if no header was sent.
+	RetryAfter time.Duration
+}
+
+func (e *circleAPIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("CircleCI API returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("CircleCI API returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// get fetches the API path with the given query parameters and decodes the
+// JSON response body into out.
+func (c *circleClient) get(path string, params url.Values, out interface{}) error {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return err
+	}
+	u = u.ResolveReference(&url.URL{Path: path})
+	if len(params) > 0 {
+		u.RawQuery = params.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Circle-Token", c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &circleAPIError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+		body, _ := io.ReadAll(resp.Body)
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &msg) == nil {
+			apiErr.Message = msg.Message
+		}
+		return apiErr
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// parseRetryAfter reads the value of a Retry-After header, which may be either
+// a number of seconds or an HTTP date.
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// getWorkflow gets the details for a specific run of a workflow
+func (c *circleClient) getWorkflow(wfID string) (*circleWorkflow, error) {
+	wf := &circleWorkflow{}
+	if err := c.get("workflow/"+url.PathEscape(wfID), nil, wf); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// getJob gets the details for a job by its number within a project
+func (c *circleClient) getJob(projectSlug string, jobNumber string) (*circleJobDetails, error) {
+	job := &circleJobDetails{}
+	if err := c.get("project/"+projectSlug+"/job/"+url.PathEscape(jobNumber), nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// listWorkflowJobs fetches one page of the jobs in a workflow. Pass an empty
+// pageToken to get the first page. The returned token is empty when there are
+// no more pages.
+func (c *circleClient) listWorkflowJobs(wfID string, pageToken string) ([]*circleJob, string, error) {
+	var page struct {
+		Items         []*circleJob `json:"items"`
+		NextPageToken *string      `json:"next_page_token"`
+	}
+	params := url.Values{}
+	if pageToken != "" {
+		params.Set("page-token", pageToken)
+	}
+	if err := c.get("workflow/"+url.PathEscape(wfID)+"/job", params, &page); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if page.NextPageToken != nil {
+		next = *page.NextPageToken
+	}
+	return page.Items, next, nil
+}
+
+// listPipelines fetches one page of the pipelines for a project, most recent
+// first. The project slug looks like gh/org/repo. If branch is not empty, only
+// pipelines for that branch are returned.
+func (c *circleClient) listPipelines(projectSlug string, branch string, pageToken string) ([]*circlePipeline, string, error) {
+	var page struct {
+		Items         []*circlePipeline `json:"items"`
+		NextPageToken *string           `json:"next_page_token"`
+	}
+	params := url.Values{}
+	if branch != "" {
+		params.Set("branch", branch)
+	}
+	if pageToken != "" {
+		params.Set("page-token", pageToken)
+	}
+	if err := c.get("project/"+projectSlug+"/pipeline", params, &page); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if page.NextPageToken != nil {
+		next = *page.NextPageToken
+	}
+	return page.Items, next, nil
+}
+
+// listPipelineWorkflows fetches one page of the workflows in a pipeline
+func (c *circleClient) listPipelineWorkflows(pipelineID string, pageToken string) ([]*circleWorkflow, string, error) {
+	var page struct {
+		Items         []*circleWorkflow `json:"items"`
+		NextPageToken *string           `json:"next_page_token"`
+	}
+	params := url.Values{}
+	if pageToken != "" {
+		params.Set("page-token", pageToken)
+	}
+	if err := c.get("pipeline/"+url.PathEscape(pipelineID)+"/workflow", params, &page); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if page.NextPageToken != nil {
+		next = *page.NextPageToken
+	}
+	return page.Items, next, nil
+}
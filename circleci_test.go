@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCircle serves the workflow job listing for a single workflow, split in
+// to pages of pageSize jobs.
+func fakeCircle(t *testing.T, wfID string, numJobs int, pageSize int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/workflow/"+wfID+"/job", r.URL.Path)
+		assert.Equal(t, "token", r.Header.Get("Circle-Token"))
+
+		start := 0
+		if tok := r.URL.Query().Get("page-token"); tok != "" {
+			fmt.Sscanf(tok, "page-%d", &start)
+		}
+		end := start + pageSize
+		if end > numJobs {
+			end = numJobs
+		}
+
+		items := ""
+		for i := start; i < end; i++ {
+			if i > start {
+				items += ","
+			}
+			items += fmt.Sprintf(`{"id":"job-%d","name":"job_%d","status":"success"}`, i, i)
+		}
+		next := "null"
+		if end < numJobs {
+			next = fmt.Sprintf(`"page-%d"`, end)
+		}
+		fmt.Fprintf(w, `{"items":[%s],"next_page_token":%s}`, items, next)
+	}))
+}
+
+func TestGetJobsPagination(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		NumJobs  int
+		PageSize int
+	}{
+		{Name: "empty", NumJobs: 0, PageSize: 20},
+		{Name: "single page", NumJobs: 5, PageSize: 20},
+		{Name: "exact page", NumJobs: 20, PageSize: 20},
+		{Name: "many pages", NumJobs: 137, PageSize: 20},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			server := fakeCircle(t, "wf-1", tc.NumJobs, tc.PageSize)
+			defer server.Close()
+
+			client := newCircleClient("token")
+			client.baseURL = server.URL + "/api/v2/"
+
+			jobs, err := getJobs(client, "wf-1")
+			assert.NoError(t, err)
+			assert.Len(t, jobs, tc.NumJobs)
+			for i, job := range jobs {
+				assert.Equal(t, fmt.Sprintf("job-%d", i), job.ID)
+			}
+		})
+	}
+}
+
+func TestGetJobsPageLimit(t *testing.T) {
+	server := fakeCircle(t, "wf-1", maxJobPages+1, 1)
+	defer server.Close()
+
+	client := newCircleClient("token")
+	client.baseURL = server.URL + "/api/v2/"
+
+	_, err := getJobs(client, "wf-1")
+	assert.Error(t, err)
+}
+
+func TestGetJobsRepeatedToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items":[{"id":"job-0","name":"job_0","status":"running"}],"next_page_token":"again"}`))
+	}))
+	defer server.Close()
+
+	client := newCircleClient("token")
+	client.baseURL = server.URL + "/api/v2/"
+
+	_, err := getJobs(client, "wf-1")
+	assert.Error(t, err)
+}
+
+func TestGetJobsAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"Workflow not found"}`))
+	}))
+	defer server.Close()
+
+	client := newCircleClient("token")
+	client.baseURL = server.URL + "/api/v2/"
+
+	_, err := getJobs(client, "wf-1")
+	var apiErr *circleAPIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.Equal(t, "Workflow not found", apiErr.Message)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, 7*time.Second, parseRetryAfter("7"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+
+	d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.Greater(t, d, 50*time.Second)
+	assert.LessOrEqual(t, d, time.Minute)
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "12")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := newCircleClient("token")
+	client.baseURL = server.URL + "/api/v2/"
+
+	_, err := client.getWorkflow("wf-1")
+	var apiErr *circleAPIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+		assert.Equal(t, 12*time.Second, apiErr.RetryAfter)
+	}
+}
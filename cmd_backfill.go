@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// backfillFetchAttempts is the number of times we'll try to fetch each page
+// from the CircleCI API before giving up on the backfill
+const backfillFetchAttempts = 5
+
+type backfillConfig struct {
+	circleKey string
+	project   string
+	branch    string
+	since     string
+	until     string
+}
+
+func commandBackfill(cfg *libhoney.Config, ecfg *eventConfig, bcfg *backfillConfig) *cobra.Command {
+	backfillCmd := &cobra.Command{
+		Use:   "backfill",
+		Short: "Sends traces for builds that have already finished",
+		Long: `
+The backfill mode reads the history of past builds from a CI provider's API and
+sends a trace for each one, with the build and job spans stamped with their
+original start times. This gives you a historical baseline for builds that ran
+before buildevents was added to them.`,
+	}
+
+	// BACKFILL CIRCLECI eg: buildevents backfill circleci --project gh/org/repo --since 2024-01-01
+	circleCmd := &cobra.Command{
+		Use:   "circleci --project SLUG --since TIME",
+		Short: "Sends traces for past CircleCI workflows",
+		Long: `
+Pages through the pipelines of a CircleCI project, newest first, and sends a
+root span for every finished workflow and a child span for every job in it
+that ran. The workflow ID is used as the trace ID and the job IDs as span IDs,
+so backfilling the same workflow twice produces the same trace.
+
+--since and --until accept a date (2006-01-02), an RFC3339 timestamp, a Unix
+timestamp, or a duration (such as 720h) meaning that long ago.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			if bcfg.circleKey == "" {
+				return fmt.Errorf("circle token required to read the API")
+			}
+			now := time.Now()
+			since, err := parseSince(bcfg.since, now)
+			if err != nil {
+				return fmt.Errorf("invalid --since: %w", err)
+			}
+			until := now
+			if bcfg.until != "" {
+				if until, err = parseSince(bcfg.until, now); err != nil {
+					return fmt.Errorf("invalid --until: %w", err)
+				}
+			}
+
+			// there may be a lot of events; wait for room rather than dropping any
+			cfg.BlockOnSend = true
+			initLibhoney(cfg, providerCircle)
+
+			client := newCircleClient(bcfg.circleKey)
+			// back off from API errors the same way watch does
+			retry := watchConfig{pollInterval: defaultPollInterval, maxBackoff: 2 * time.Minute}
+			var numWorkflows, numJobs int
+			err = walkCircleWorkflows(client, retry, bcfg.project, bcfg.branch, since, until,
+				func(p *circlePipeline, wf *circleWorkflow, jobs []*circleJob) error {
+					numWorkflows++
+					numJobs += sendCircleWorkflow(cfg, ecfg, p, wf, jobs)
+					return nil
+				})
+			libhoney.Flush()
+			fmt.Fprintf(os.Stderr, "backfilled %d workflows with %d jobs\n", numWorkflows, numJobs)
+			return err
+		},
+	}
+
+	circleCmd.Flags().StringVarP(&bcfg.circleKey, "circlekey", "c", "", "[env.BUILDEVENT_CIRCLE_API_TOKEN] CircleCI API token used to read the project history")
+	if tok, ok := os.LookupEnv("BUILDEVENT_CIRCLE_API_TOKEN"); ok {
+		circleCmd.Flags().Lookup("circlekey").Value.Set(tok)
+	}
+	circleCmd.Flags().StringVar(&bcfg.project, "project", "", "CircleCI project slug, such as gh/org/repo")
+	circleCmd.Flags().StringVar(&bcfg.branch, "branch", "", "only backfill pipelines for this branch")
+	circleCmd.Flags().StringVar(&bcfg.since, "since", "", "backfill workflows created at or after this time")
+	circleCmd.Flags().StringVar(&bcfg.until, "until", "", "backfill workflows created before this time (default now)")
+	circleCmd.MarkFlagRequired("project")
+	circleCmd.MarkFlagRequired("since")
+
+	backfillCmd.AddCommand(circleCmd)
+	return backfillCmd
+}
+
+// walkCircleWorkflows calls fn for every finished workflow in the project that
+// was created between since and until, along with the jobs in that workflow.
+// Pipelines are listed newest first, so we stop paging once we see one that
+// was created before since. Retryable API errors are retried with backoff.
+func walkCircleWorkflows(client *circleClient, retry watchConfig, project, branch string, since, until time.Time,
+	fn func(*circlePipeline, *circleWorkflow, []*circleJob) error) error {
+	pageToken := ""
+	for {
+		var pipelines []*circlePipeline
+		var next string
+		err := withRetries(retry, "listing pipelines", func() (err error) {
+			pipelines, next, err = client.listPipelines(project, branch, pageToken)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range pipelines {
+			if p.CreatedAt.Before(since) {
+				return nil
+			}
+			if !p.CreatedAt.Before(until) {
+				continue
+			}
+
+			wfToken := ""
+			for {
+				var workflows []*circleWorkflow
+				var wfNext string
+				err := withRetries(retry, "listing workflows", func() (err error) {
+					workflows, wfNext, err = client.listPipelineWorkflows(p.ID, wfToken)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				for _, wf := range workflows {
+					if wf.StoppedAt.IsZero() {
+						// still running (or on hold); there's no build to report yet
+						continue
+					}
+					var jobs []*circleJob
+					err := withRetries(retry, "listing jobs", func() (err error) {
+						jobs, err = getJobs(client, wf.ID)
+						return err
+					})
+					if err != nil {
+						return err
+					}
+					if err := fn(p, wf, jobs); err != nil {
+						return err
+					}
+				}
+				if wfNext == "" {
+					break
+				}
+				wfToken = wfNext
+			}
+		}
+		if next == "" || next == pageToken {
+			return nil
+		}
+		pageToken = next
+	}
+}
+
+// withRetries calls fetch until it succeeds, it returns an error that isn't
+// retryable, or it has failed backfillFetchAttempts times, waiting between
+// attempts as pollDelay says.
+func withRetries(retry watchConfig, what string, fetch func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fetch()
+		if err == nil || attempt >= backfillFetchAttempts || !isRetryable(err) {
+			return err
+		}
+		delay := pollDelay(retry, attempt, err)
+		fmt.Fprintf(os.Stderr, "%s failed with %s; retrying in %s.\n", what, err.Error(), delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// sendCircleWorkflow sends the root span for a workflow and a span for each of
+// its jobs that ran, returning the number of job spans sent.
+func sendCircleWorkflow(cfg *libhoney.Config, ecfg *eventConfig, p *circlePipeline, wf *circleWorkflow, jobs []*circleJob) int {
+	ev := newEvent(providerCircle, wf.ID)
+	ev.Add(map[string]interface{}{
+		"service_name":  ifClassic(cfg, "build", cfg.Dataset),
+		"service.name":  ifClassic(cfg, "build", cfg.Dataset),
+		"command_name":  "backfill",
+		"trace.span_id": wf.ID,
+		"name":          "build " + wf.ID,
+		"status":        circleOutcome(wf.Status),
+		"duration_ms":   wf.StoppedAt.Sub(wf.CreatedAt) / time.Millisecond,
+		"source":        "buildevents",
+		"workflow_name": wf.Name,
+		"build_num":     p.Number,
+		"branch":        p.VCS.Branch,
+		"repo":          p.VCS.OriginRepositoryURL,
+		"pr_user":       p.Trigger.Actor.Login,
+	})
+	ev.Timestamp = wf.CreatedAt
+	sendEvent(ecfg, ev)
+
+	sent := 0
+	for _, job := range jobs {
+		if job.StartedAt == nil || job.StoppedAt == nil {
+			// blocked, canceled before starting, or an approval job
+			continue
+		}
+		jev := newEvent(providerCircle, wf.ID)
+		jev.Add(map[string]interface{}{
+			"trace.parent_id": wf.ID,
+			"trace.span_id":   job.ID,
+			"service_name":    ifClassic(cfg, "step", cfg.Dataset),
+			"service.name":    ifClassic(cfg, "step", cfg.Dataset),
+			"command_name":    "backfill",
+			"name":            job.Name,
+			"status":          circleOutcome(job.Status),
+			"duration_ms":     job.StoppedAt.Sub(*job.StartedAt) / time.Millisecond,
+			"source":          "buildevents",
+			"job_name":        job.Name,
+			"build_num":       job.JobNumber,
+			"branch":          p.VCS.Branch,
+		})
+		jev.Timestamp = *job.StartedAt
+		sendEvent(ecfg, jev)
+		sent++
+	}
+	return sent
+}
+
+// circleOutcome turns the status of a finished CircleCI workflow or job in to
+// the success, failed or canceled that watch reports, so that backfilled
+// spans can be compared with live ones.
+func circleOutcome(status string) string {
+	switch status {
+	case "success":
+		return "success"
+	case "canceled", "not_run":
+		return "canceled"
+	}
+	return "failed"
+}
+
+// parseSince reads a point in time given as a date, an RFC3339 timestamp, a
+// Unix timestamp, or a duration before now.
+func parseSince(val string, now time.Time) (time.Time, error) {
+	val = strings.TrimSpace(val)
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", val); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if d, err := time.ParseDuration(val); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("unable to parse %q as a date, timestamp, or duration", val)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// fastRetries backs off quickly enough for tests
+var fastRetries = watchConfig{pollInterval: time.Millisecond, maxBackoff: 5 * time.Millisecond}
+
+func TestWalkCircleWorkflows(t *testing.T) {
+	// the second page of pipelines and the jobs for wf2 fail the first time
+	failed := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.URL.Path + "?" + r.URL.RawQuery; !failed[key] {
+			switch key {
+			case "/api/v2/project/gh/org/repo/pipeline?page-token=more":
+				failed[key] = true
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case "/api/v2/workflow/wf2/job?":
+				failed[key] = true
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
+		switch r.URL.Path {
+		case "/api/v2/project/gh/org/repo/pipeline":
+			if r.URL.Query().Get("page-token") == "" {
+				w.Write([]byte(`{"items":[
+					{"id":"p4","number":4,"created_at":"2024-03-04T00:00:00Z"},
+					{"id":"p3","number":3,"created_at":"2024-03-03T00:00:00Z"}
+				],"next_page_token":"more"}`))
+				return
+			}
+			w.Write([]byte(`{"items":[
+				{"id":"p2","number":2,"created_at":"2024-03-02T00:00:00Z"},
+				{"id":"p1","number":1,"created_at":"2024-03-01T00:00:00Z"}
+			],"next_page_token":"never-fetched"}`))
+		case "/api/v2/pipeline/p3/workflow":
+			w.Write([]byte(`{"items":[
+				{"id":"wf3","name":"build","status":"success","created_at":"2024-03-03T00:00:00Z","stopped_at":"2024-03-03T00:10:00Z"},
+				{"id":"wf3-held","name":"deploy","status":"on_hold","created_at":"2024-03-03T00:00:00Z"}
+			],"next_page_token":null}`))
+		case "/api/v2/pipeline/p2/workflow":
+			w.Write([]byte(`{"items":[
+				{"id":"wf2","name":"build","status":"failed","created_at":"2024-03-02T00:00:00Z","stopped_at":"2024-03-02T00:10:00Z"}
+			],"next_page_token":null}`))
+		case "/api/v2/workflow/wf3/job", "/api/v2/workflow/wf2/job":
+			w.Write([]byte(`{"items":[{"id":"job-1","name":"test","status":"success"}],"next_page_token":null}`))
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := newCircleClient("token")
+	client.baseURL = server.URL + "/api/v2/"
+
+	since := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	var seen []string
+	err := walkCircleWorkflows(client, fastRetries, "gh/org/repo", "", since, until,
+		func(p *circlePipeline, wf *circleWorkflow, jobs []*circleJob) error {
+			seen = append(seen, wf.ID)
+			assert.Len(t, jobs, 1)
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"wf3", "wf2"}, seen)
+	assert.Len(t, failed, 2)
+}
+
+func TestWalkCircleWorkflowsGivesUp(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		status   int
+		requests int
+	}{
+		{"retryable errors are retried", http.StatusBadGateway, backfillFetchAttempts},
+		{"other errors are not", http.StatusNotFound, 1},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(tC.status)
+			}))
+			defer server.Close()
+
+			client := newCircleClient("token")
+			client.baseURL = server.URL + "/api/v2/"
+
+			err := walkCircleWorkflows(client, fastRetries, "gh/org/repo", "", time.Time{}, time.Now(),
+				func(p *circlePipeline, wf *circleWorkflow, jobs []*circleJob) error {
+					t.Error("no workflows should be found")
+					return nil
+				})
+			var apiErr *circleAPIError
+			if assert.ErrorAs(t, err, &apiErr) {
+				assert.Equal(t, tC.status, apiErr.StatusCode)
+			}
+			assert.Equal(t, tC.requests, requests)
+		})
+	}
+}
+
+func TestSendCircleWorkflow(t *testing.T) {
+	mock := &transmission.MockSender{}
+	cfg := &libhoney.Config{APIKey: "abcdef123456abcdef1234", Dataset: "builds", Transmission: mock}
+	libhoney.Init(*cfg)
+	defer libhoney.Close()
+
+	created := time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)
+	jobStart := created.Add(30 * time.Second)
+	jobStop := jobStart.Add(90 * time.Second)
+
+	var p circlePipeline
+	p.Number = 42
+	p.VCS.Branch = "main"
+	wf := &circleWorkflow{ID: "wf-1", Name: "build", Status: "success", CreatedAt: created, StoppedAt: created.Add(10 * time.Minute)}
+	jobs := []*circleJob{
+		{ID: "job-1", Name: "test", JobNumber: 7, Status: "failed", StartedAt: &jobStart, StoppedAt: &jobStop},
+		{ID: "job-2", Name: "deploy", Status: "blocked"},
+	}
+
+	sent := sendCircleWorkflow(cfg, &eventConfig{}, &p, wf, jobs)
+	assert.Equal(t, 1, sent)
+
+	events := mock.Events()
+	require.Len(t, events, 2)
+	build, job := events[0], events[1]
+
+	assert.Equal(t, created, build.Timestamp)
+	assert.Equal(t, "wf-1", build.Data["trace.trace_id"])
+	assert.Equal(t, "wf-1", build.Data["trace.span_id"])
+	assert.NotContains(t, build.Data, "trace.parent_id")
+	assert.Equal(t, "success", build.Data["status"])
+	assert.Equal(t, 10*time.Minute/time.Millisecond, build.Data["duration_ms"])
+	assert.Equal(t, 42, build.Data["build_num"])
+	assert.Equal(t, "main", build.Data["branch"])
+
+	assert.Equal(t, jobStart, job.Timestamp)
+	assert.Equal(t, "wf-1", job.Data["trace.trace_id"])
+	assert.Equal(t, "wf-1", job.Data["trace.parent_id"])
+	assert.Equal(t, "job-1", job.Data["trace.span_id"])
+	assert.Equal(t, "test", job.Data["name"])
+	assert.Equal(t, "failed", job.Data["status"])
+	assert.Equal(t, 90*time.Second/time.Millisecond, job.Data["duration_ms"])
+	assert.Equal(t, 7, job.Data["build_num"])
+
+	// other statuses are reported the same way as watch reports them
+	wf = &circleWorkflow{ID: "wf-2", Name: "build", Status: "canceled", CreatedAt: created, StoppedAt: created.Add(time.Minute)}
+	jobs = []*circleJob{
+		{ID: "job-3", Name: "lint", Status: "canceled", StartedAt: &jobStart, StoppedAt: &jobStop},
+		{ID: "job-4", Name: "test", Status: "infrastructure_fail", StartedAt: &jobStart, StoppedAt: &jobStop},
+	}
+	assert.Equal(t, 2, sendCircleWorkflow(cfg, &eventConfig{}, &p, wf, jobs))
+	events = mock.Events()
+	require.Len(t, events, 5)
+	assert.Equal(t, "canceled", events[2].Data["status"])
+	assert.Equal(t, "canceled", events[3].Data["status"])
+	assert.Equal(t, "failed", events[4].Data["status"])
+}
+
+func TestCircleOutcome(t *testing.T) {
+	for status, expect := range map[string]string{
+		"success":             "success",
+		"failed":              "failed",
+		"error":               "failed",
+		"failing":             "failed",
+		"infrastructure_fail": "failed",
+		"timedout":            "failed",
+		"canceled":            "canceled",
+		"not_run":             "canceled",
+	} {
+		assert.Equal(t, expect, circleOutcome(status), status)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	ts, err := parseSince("2024-03-02", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), ts)
+
+	ts, err = parseSince("2024-03-02T10:00:00Z", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC), ts)
+
+	ts, err = parseSince("1709337600", now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1709337600), ts.Unix())
+
+	ts, err = parseSince("24h", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC), ts)
+
+	_, err = parseSince("last tuesday", now)
+	assert.Error(t, err)
+}
@@ -11,7 +11,7 @@ import (
 	libhoney "github.com/honeycombio/libhoney-go"
 )
 
-func commandBuild(cfg *libhoney.Config, filename *string, ciProvider *string) *cobra.Command {
+func commandBuild(cfg *libhoney.Config, ecfg *eventConfig, filename *string, ciProvider *string, dcfg *diffConfig) *cobra.Command {
 	// BUILD - eg: buildevents build $TRAVIS_BUILD_ID $BUILD_START success
 	buildCmd := &cobra.Command{
 		Use:   "build [flags] BUILD_ID BUILD_START OUTCOME",
@@ -27,8 +27,8 @@ a URL pointing to the generated trace in Honeycomb to STDOUT.`,
 			startTime := parseUnix(strings.TrimSpace(args[1]))
 			outcome := strings.TrimSpace(args[2])
 
-			ev := createEvent(cfg, *ciProvider, traceID)
-			defer ev.Send()
+			ev := createEvent(cfg, ecfg, *ciProvider, traceID)
+			defer sendEvent(ecfg, ev)
 
 			providerInfo(*ciProvider, ev)
 
@@ -44,7 +44,8 @@ a URL pointing to the generated trace in Honeycomb to STDOUT.`,
 			})
 			ev.Timestamp = startTime
 
-			arbitraryFields(*filename, ev)
+			diffInfo(dcfg, ev)
+			arbitraryFields(ecfg, *filename, ev)
 
 			url, err := buildURL(cfg, traceID, startTime.Unix())
 			if err != nil {
@@ -56,6 +57,7 @@ a URL pointing to the generated trace in Honeycomb to STDOUT.`,
 			return nil
 		},
 	}
+	addDiffFlags(buildCmd, dcfg)
 	return buildCmd
 }
 
@@ -14,10 +14,10 @@ import (
 	libhoney "github.com/honeycombio/libhoney-go"
 )
 
-func commandCmd(cfg *libhoney.Config, filename *string, ciProvider *string) *cobra.Command {
+func commandCmd(cfg *libhoney.Config, ecfg *eventConfig, filename *string, ciProvider *string) *cobra.Command {
 	// CMD eg: buildevents cmd $TRAVIS_BUILD_ID $STAGE_SPAN_ID go-test -- go test github.com/honeycombio/hound/...
 	execCmd := &cobra.Command{
-		Use:   "cmd [flags] BUILD_ID STEP_ID NAME -- [shell command to execute]",
+		Use:   "cmd [flags] [BUILD_ID STEP_ID] NAME -- [shell command to execute]",
 		Short: "Invoke an individual command that is part of the build.",
 		Long: `
 The cmd mode invokes an individual command that is part of the build, such as
@@ -25,39 +25,58 @@ running DB migrations or running a specific test suite. It must be able to be
 expressed as a single shell command - either a process like "go test" or a
 shell script. The command to run is the final argument to buildevents and
 will be launched via "bash -c" using "exec". The shell can be changed with the
--s/--shell flag.`,
-		Args: cobra.MatchAll(
-			cobra.MinimumNArgs(4),
-			func(cmd *cobra.Command, args []string) error {
-				if cmd.ArgsLenAtDash() != 3 {
-					return fmt.Errorf("use `--` to signify shell command")
-				}
-				return nil
-			},
-		),
+-s/--shell flag.
+
+When run by another buildevents cmd, BUILD_ID and STEP_ID may be "-" or left
+out, and are taken from the HONEYCOMB_TRACE environment variable it exports,
+nesting this command under that one.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			dash := cmd.ArgsLenAtDash()
+			if dash != 1 && dash != 3 {
+				return fmt.Errorf("use `--` to signify shell command")
+			}
+			if len(args) == dash {
+				return fmt.Errorf("no shell command given after `--`")
+			}
+			return nil
+		},
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			traceID, stepID := "-", "-"
+			if cmd.ArgsLenAtDash() == 3 {
+				traceID = strings.TrimSpace(args[0])
+				stepID = strings.TrimSpace(args[1])
+				args = args[2:]
+			}
+			noNest, _ := cmd.Flags().GetBool("no-nest")
+			inherited := inheritedTrace()
+			traceID, parentID, err := cmdParent(traceID, stepID, inherited, noNest)
+			if err != nil {
+				return err
+			}
+
 			// Don't show usage if RunE returns an error. This set in RunE
 			// instead of when we instantiate the cmd so we don't suppress usage
 			// for errors from Args.
 			cmd.SilenceUsage = true
 
-			traceID := strings.TrimSpace(args[0])
-			stepID := strings.TrimSpace(args[1])
-			name := strings.TrimSpace(args[2])
+			name := strings.TrimSpace(args[0])
 			quiet, _ := cmd.Flags().GetBool("quiet")
 			shell, _ := cmd.Flags().GetString("shell")
 
 			var quoted []string
-			for _, s := range args[3:] {
+			for _, s := range args[1:] {
 				quoted = append(quoted, fmt.Sprintf("\"%s\"", strings.Replace(s, "\"", "\\\"", -1)))
 			}
 			subcmd := strings.Join(quoted, " ")
 
-			ev := createEvent(cfg, *ciProvider, traceID)
-			defer ev.Send()
+			ev := createEvent(cfg, ecfg, *ciProvider, traceID)
+			defer sendEvent(ecfg, ev)
 
 			providerInfo(*ciProvider, ev)
+			if inherited != nil && inherited.TraceID == traceID {
+				inheritFields(ev, inherited.TraceContext)
+			}
 
 			spanBytes := make([]byte, 16)
 			rand.Read(spanBytes)
@@ -75,11 +94,45 @@ will be launched via "bash -c" using "exec". The shell can be changed with the
 				ParentID:     spanID,
 				TraceContext: localFields,
 			}
-			err := runCommand(subcmd, prop, quiet, shell)
+
+			// give the command a file of its own to write fields for this span to
+			var env []string
+			fieldsLoc, ferr := newCmdFieldsFile()
+			if ferr != nil {
+				fmt.Fprintf(os.Stderr, "unable to create fields file for command: %v\n", ferr)
+			} else {
+				defer os.Remove(fieldsLoc)
+				env = append(env, "BUILDEVENT_CMD_FIELDS="+fieldsLoc)
+			}
+
+			// and a socket it can send spans to, nested under this one
+			server, serr := newSpanServer(spanID, func(fields map[string]interface{}, start time.Time) {
+				sev := newEvent(*ciProvider, traceID)
+				sev.Add(localFields)
+				sev.Add(map[string]interface{}{
+					"service_name": ifClassic(cfg, "cmd", cfg.Dataset),
+					"service.name": ifClassic(cfg, "cmd", cfg.Dataset),
+					"command_name": "cmd",
+					"source":       "buildevents",
+				})
+				sev.Add(fields)
+				sev.Timestamp = start
+				sendEvent(ecfg, sev)
+			})
+			if serr != nil {
+				fmt.Fprintf(os.Stderr, "unable to create span socket for command: %v\n", serr)
+			} else {
+				env = append(env, "BUILDEVENT_SOCKET="+server.path())
+			}
+
+			err = runCommand(subcmd, prop, quiet, shell, env)
 			dur := time.Since(start)
+			if server != nil {
+				server.close()
+			}
 
 			ev.Add(map[string]interface{}{
-				"trace.parent_id": stepID,
+				"trace.parent_id": parentID,
 				"trace.span_id":   spanID,
 				"service_name":    ifClassic(cfg, "cmd", cfg.Dataset),
 				"service.name":    ifClassic(cfg, "cmd", cfg.Dataset),
@@ -93,7 +146,10 @@ will be launched via "bash -c" using "exec". The shell can be changed with the
 
 			// Annotate with arbitrary fields after the command runs
 			// this way we can consume a file if the command itself generated one
-			arbitraryFields(*filename, ev)
+			arbitraryFields(ecfg, *filename, ev)
+			if fieldsLoc != "" {
+				cmdFields(ecfg, fieldsLoc, ev)
+			}
 
 			if err == nil {
 				ev.AddField("status", "success")
@@ -112,10 +168,97 @@ will be launched via "bash -c" using "exec". The shell can be changed with the
 	var shell string
 	execCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence non-cmd output")
 	execCmd.Flags().StringVarP(&shell, "shell", "s", "/bin/bash", "path of shell executable to use for command, must accept -c as an argument")
+	execCmd.Flags().Bool("no-nest", false, "[env.BUILDEVENT_NO_NEST] nest under STEP_ID even when run inside another buildevents cmd in the same trace")
+	if nn, ok := os.LookupEnv("BUILDEVENT_NO_NEST"); ok {
+		execCmd.Flags().Lookup("no-nest").Value.Set(nn)
+	}
 	return execCmd
 }
 
-func runCommand(subcmd string, prop *propagation.PropagationContext, quiet bool, shell string) error {
+// inheritedTrace returns the trace context exported by a buildevents cmd we
+// are running inside of, or nil if there isn't one.
+func inheritedTrace() *propagation.PropagationContext {
+	header := os.Getenv("HONEYCOMB_TRACE")
+	if !strings.Contains(header, ";") {
+		return nil
+	}
+	prop, err := propagation.UnmarshalHoneycombTraceContext(header)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ignoring invalid HONEYCOMB_TRACE: %v\n", err)
+		return nil
+	}
+	return prop
+}
+
+// cmdParent works out the trace and parent span for a cmd. A BUILD_ID or
+// STEP_ID of "-" is taken from the inherited trace context, and when run inside
+// another cmd in the same trace, the cmd is nested under it rather than the
+// step, unless noNest is set and there is a step to use.
+func cmdParent(traceID, stepID string, inherited *propagation.PropagationContext, noNest bool) (string, string, error) {
+	if traceID == "-" || traceID == "" {
+		if inherited == nil || inherited.TraceID == "" {
+			return "", "", fmt.Errorf("BUILD_ID is required when not run by buildevents cmd")
+		}
+		traceID = inherited.TraceID
+	}
+	sameTrace := inherited != nil && inherited.TraceID == traceID && inherited.ParentID != ""
+	if stepID == "-" || stepID == "" {
+		if !sameTrace {
+			return "", "", fmt.Errorf("STEP_ID is required when not run by buildevents cmd in the same trace")
+		}
+		return traceID, inherited.ParentID, nil
+	}
+	if sameTrace && !noNest {
+		return traceID, inherited.ParentID, nil
+	}
+	return traceID, stepID, nil
+}
+
+// inheritFields adds the trace-level fields propagated by the outer cmd that
+// aren't already set on the event.
+func inheritFields(ev *libhoney.Event, fields map[string]interface{}) {
+	existing := ev.Fields()
+	for k, v := range fields {
+		if _, ok := existing[k]; !ok {
+			ev.AddField(k, v)
+		}
+	}
+}
+
+// newCmdFieldsFile creates an empty file for a command to write fields to
+func newCmdFieldsFile() (string, error) {
+	f, err := os.CreateTemp("", "buildevents-cmd-fields-*")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// cmdFields adds the fields the command wrote to its fields file. Each line is
+// either a JSON object or logfmt pairs.
+func cmdFields(ecfg *eventConfig, loc string, ev *libhoney.Event) {
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read %q: %v\n", loc, err)
+		return
+	}
+	typed := ecfg.typedFields || ecfg.fieldSchema != ""
+	schema, err := loadFieldSchema(ecfg.fieldSchema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load field schema: %v\n", err)
+	}
+
+	fields, err := parseFieldLines(data, typed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "problems loading fields written by the command: %v\n", err)
+	}
+	for _, err := range schema.apply(fields) {
+		fmt.Fprintf(os.Stderr, "problems loading fields written by the command: %v\n", err)
+	}
+	ev.Add(fields)
+}
+
+func runCommand(subcmd string, prop *propagation.PropagationContext, quiet bool, shell string, env []string) error {
 	if !quiet {
 		fmt.Println("running", shell, "-c", subcmd)
 	}
@@ -124,6 +267,7 @@ func runCommand(subcmd string, prop *propagation.PropagationContext, quiet bool,
 	cmd.Env = append(os.Environ(),
 		"HONEYCOMB_TRACE="+propagation.MarshalHoneycombTraceContext(prop),
 	)
+	cmd.Env = append(cmd.Env, env...)
 
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
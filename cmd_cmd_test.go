@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	propagation "github.com/honeycombio/beeline-go/propagation"
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+func TestInheritedTrace(t *testing.T) {
+	t.Setenv("HONEYCOMB_TRACE", "")
+	assert.Nil(t, inheritedTrace())
+
+	t.Setenv("HONEYCOMB_TRACE", "garbage")
+	assert.Nil(t, inheritedTrace())
+
+	t.Setenv("HONEYCOMB_TRACE", "2;trace_id=abc")
+	assert.Nil(t, inheritedTrace())
+
+	t.Setenv("HONEYCOMB_TRACE", propagation.MarshalHoneycombTraceContext(&propagation.PropagationContext{
+		TraceID:      "build-1",
+		ParentID:     "outer-cmd",
+		TraceContext: map[string]interface{}{"ci_provider": "GitHub Actions"},
+	}))
+	prop := inheritedTrace()
+	require.NotNil(t, prop)
+	assert.Equal(t, "build-1", prop.TraceID)
+	assert.Equal(t, "outer-cmd", prop.ParentID)
+	assert.Equal(t, "GitHub Actions", prop.TraceContext["ci_provider"])
+}
+
+func TestCmdParent(t *testing.T) {
+	outer := &propagation.PropagationContext{TraceID: "build-1", ParentID: "outer-cmd"}
+	testCases := []struct {
+		desc      string
+		traceID   string
+		stepID    string
+		inherited *propagation.PropagationContext
+		wantTrace string
+		wantPar   string
+	}{
+		{"explicit ids", "build-1", "step-1", nil, "build-1", "step-1"},
+		{"nested in the same trace", "build-1", "step-1", outer, "build-1", "outer-cmd"},
+		{"outer cmd in another trace", "build-2", "step-1", outer, "build-2", "step-1"},
+		{"dashes", "-", "-", outer, "build-1", "outer-cmd"},
+		{"omitted", "", "", outer, "build-1", "outer-cmd"},
+		{"dash for the step only", "build-1", "-", outer, "build-1", "outer-cmd"},
+		{"dash for the build only", "-", "step-1", outer, "build-1", "outer-cmd"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			traceID, parentID, err := cmdParent(tC.traceID, tC.stepID, tC.inherited, false)
+			require.NoError(t, err)
+			assert.Equal(t, tC.wantTrace, traceID)
+			assert.Equal(t, tC.wantPar, parentID)
+		})
+	}
+
+	// --no-nest keeps an explicit step, but there has to be one
+	_, parentID, err := cmdParent("build-1", "step-1", outer, true)
+	require.NoError(t, err)
+	assert.Equal(t, "step-1", parentID)
+	_, parentID, err = cmdParent("-", "-", outer, true)
+	require.NoError(t, err)
+	assert.Equal(t, "outer-cmd", parentID)
+
+	_, _, err = cmdParent("-", "-", nil, false)
+	assert.Error(t, err)
+	_, _, err = cmdParent("build-1", "-", nil, false)
+	assert.Error(t, err)
+	_, _, err = cmdParent("build-2", "-", outer, false)
+	assert.Error(t, err)
+}
+
+func TestInheritFields(t *testing.T) {
+	ev := libhoney.NewEvent()
+	ev.AddField("ci_provider", "GitHub Actions")
+	inheritFields(ev, map[string]interface{}{
+		"ci_provider": "Jenkins",
+		"app.release": "1.2.3",
+	})
+	assert.Equal(t, map[string]interface{}{
+		"ci_provider": "GitHub Actions",
+		"app.release": "1.2.3",
+	}, ev.Fields())
+}
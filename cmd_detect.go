@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func commandDetect(ciProvider *string) *cobra.Command {
+	// DETECT eg: buildevents detect
+	detectCmd := &cobra.Command{
+		Use:   "detect",
+		Short: "Shows which CI provider was detected and why",
+		Long: `
+The detect mode prints which CI provider buildevents would use, the environment
+variables that led to that choice, and the fields that would be added to every
+span as a result. It sends nothing to Honeycomb.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := cmd.OutOrStdout()
+			matches := scoreProviders(os.LookupEnv)
+
+			explicit := cmd.Flags().Changed("provider") || os.Getenv("BUILDEVENT_CIPROVIDER") != ""
+			switch {
+			case *ciProvider == "":
+				fmt.Fprintln(out, "Provider: none detected")
+			case explicit:
+				fmt.Fprintf(out, "Provider: %s (set explicitly)\n", *ciProvider)
+			default:
+				fmt.Fprintf(out, "Provider: %s (detected)\n", *ciProvider)
+			}
+
+			if len(matches) == 0 {
+				fmt.Fprintln(out, "\nNo provider detection rules matched the environment.")
+			} else {
+				fmt.Fprintf(out, "\nDetection scores (at least %d needed):\n", minDetectScore)
+				for _, m := range matches {
+					fmt.Fprintf(out, "  %-20s %3d  %s\n", m.def.Name, m.score, strings.Join(m.reasons, ", "))
+				}
+			}
+
+			def := lookupProvider(*ciProvider)
+			if def == nil {
+				if *ciProvider != "" {
+					fmt.Fprintf(out, "\n%q has no field mappings; only ci_provider will be added.\n", *ciProvider)
+				}
+				return nil
+			}
+			if def.TraceID != "" {
+				fmt.Fprintf(out, "\nRecommended trace ID: $%s (%q)\n", def.TraceID, os.Getenv(def.TraceID))
+			}
+
+			fields := providerFields(def, os.LookupEnv)
+			if len(fields) == 0 {
+				fmt.Fprintln(out, "\nNo provider fields are set in the environment.")
+				return nil
+			}
+			fmt.Fprintln(out, "\nFields that will be added:")
+			for _, f := range fields {
+				fmt.Fprintf(out, "  %s=%q (from %s)\n", f.name, f.value, f.envVar)
+			}
+			return nil
+		},
+	}
+	return detectCmd
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -10,7 +11,8 @@ import (
 	libhoney "github.com/honeycombio/libhoney-go"
 )
 
-func commandRoot(cfg *libhoney.Config, filename *string, ciProvider *string, serviceName *string) *cobra.Command {
+func commandRoot(cfg *libhoney.Config, ecfg *eventConfig, filename *string, ciProvider *string, serviceName *string) *cobra.Command {
+	var providerMap string
 	root := &cobra.Command{
 		Version: Version,
 		Use:     "buildevents",
@@ -18,7 +20,7 @@ func commandRoot(cfg *libhoney.Config, filename *string, ciProvider *string, ser
 		Long: `
 The buildevents executable creates Honeycomb events and tracing information
 about your Continuous Integration builds.`,
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			quiet, _ := cmd.Flags().GetBool("quiet")
 			if cfg.IsClassic() {
 				// if we're in classic mode, we want to behave the same as we always have
@@ -49,6 +51,17 @@ about your Continuous Integration builds.`,
 					}
 				}
 			}
+			if err := loadProviderMap(providerMap); err != nil && !quiet {
+				fmt.Fprintf(os.Stderr, "WARN: unable to load provider map: %v\n", err)
+			}
+			*ciProvider = resolveProvider(*ciProvider)
+
+			r, err := newRedactor(ecfg.redactPatterns, os.Environ(), secretEnvPatterns(ecfg), cfg.APIKey)
+			if err != nil {
+				return err
+			}
+			ecfg.redactor = r
+			return nil
 		},
 	}
 
@@ -73,35 +86,78 @@ about your Continuous Integration builds.`,
 		root.PersistentFlags().Lookup("apihost").Value.Set(apihost)
 	}
 
-	root.PersistentFlags().StringVarP(filename, "filename", "f", "", "[env.BUILDEVENT_FILE] the path of a text file holding arbitrary key=val pairs (multi-line-capable, logfmt style) to be added to the Honeycomb event")
+	root.PersistentFlags().StringVarP(filename, "filename", "f", "", "[env.BUILDEVENT_FILE] the path of a text file of arbitrary fields (logfmt style key=val pairs, JSON, YAML or dotenv) to be added to the Honeycomb event")
 	if fname, ok := os.LookupEnv("BUILDEVENT_FILE"); ok {
 		root.PersistentFlags().Lookup("filename").Value.Set(fname)
 	}
 
-	root.PersistentFlags().StringVarP(ciProvider, "provider", "p", "", "[env.BUILDEVENT_CIPROVIDER] if unset, will inspect the environment to try to detect common CI providers.")
-	prov := os.Getenv("BUILDEVENT_CIPROVIDER")
-	if prov == "" {
-		if _, present := os.LookupEnv("TRAVIS"); present {
-			prov = providerTravis
-		} else if _, present := os.LookupEnv("CIRCLECI"); present {
-			prov = providerCircle
-		} else if _, present := os.LookupEnv("GITLAB_CI"); present {
-			prov = providerGitLab
-		} else if _, present := os.LookupEnv("BUILDKITE"); present {
-			prov = providerBuildkite
-		} else if _, present := os.LookupEnv("JENKINS-X"); present {
-			prov = providerJenkinsX
-		} else if _, present := os.LookupEnv("GOOGLE-CLOUD-BUILD"); present {
-			prov = providerGoogleCloudBuild
-		} else if _, present := os.LookupEnv("TF_BUILD"); present {
-			prov = providerAzurePipelines
-		} else if _, present := os.LookupEnv("GITHUB_ACTIONS"); present {
-			prov = providerGitHubActions
-		} else if _, present := os.LookupEnv("BITBUCKET_BUILD_NUMBER"); present {
-			prov = providerBitbucketPipelines
+	root.PersistentFlags().StringArrayVar(&ecfg.fieldFiles, "field-file", nil, "[env.BUILDEVENT_FIELD_FILES] the path of another file of arbitrary fields, which may be repeated; fields in later files override earlier ones and those in the --filename file")
+	if ffiles, ok := os.LookupEnv("BUILDEVENT_FIELD_FILES"); ok {
+		// a list of paths separated like $PATH, so that paths may contain commas
+		for _, ffile := range filepath.SplitList(ffiles) {
+			root.PersistentFlags().Lookup("field-file").Value.Set(ffile)
 		}
 	}
-	if prov != "" {
+
+	root.PersistentFlags().StringArrayVar(&ecfg.fields, "field", nil, "a key=val field to add to the Honeycomb event, which may be repeated and overrides fields from files; use key:int=val, key:float=val, key:bool=val or key:str=val to set its type rather than guessing it")
+
+	root.PersistentFlags().BoolVar(&ecfg.typedFields, "typed-fields", false, "[env.BUILDEVENT_TYPED_FIELDS] keep quoted values in fields files as strings, and only turn other values in to numbers or booleans when that doesn't change them, so 1.10 and 02134 stay strings")
+	if tf, ok := os.LookupEnv("BUILDEVENT_TYPED_FIELDS"); ok {
+		root.PersistentFlags().Lookup("typed-fields").Value.Set(tf)
+	}
+
+	root.PersistentFlags().StringVar(&ecfg.fieldSchema, "field-schema", "", "[env.BUILDEVENT_FIELD_SCHEMA] the path of a YAML or JSON file mapping field names (or glob patterns) to their types, one of string, int, float or bool; implies --typed-fields")
+	if fs, ok := os.LookupEnv("BUILDEVENT_FIELD_SCHEMA"); ok {
+		root.PersistentFlags().Lookup("field-schema").Value.Set(fs)
+	}
+
+	root.PersistentFlags().StringVar(&ecfg.fileFormat, "filename-format", "", "[env.BUILDEVENT_FILE_FORMAT] the format of the --filename and --field-file files, one of logfmt, json, yaml or dotenv; if unset, it is chosen by the file's extension (.json, .yaml, .yml or .env) and is otherwise logfmt")
+	if ffmt, ok := os.LookupEnv("BUILDEVENT_FILE_FORMAT"); ok {
+		root.PersistentFlags().Lookup("filename-format").Value.Set(ffmt)
+	}
+
+	root.PersistentFlags().BoolVar(&ecfg.otelSemconv, "otel-semconv", false, "[env.BUILDEVENT_OTEL_SEMCONV] also add OpenTelemetry CICD and VCS semantic convention attributes, such as cicd.pipeline.run.id and vcs.ref.head.name")
+	if sc, ok := os.LookupEnv("BUILDEVENT_OTEL_SEMCONV"); ok {
+		root.PersistentFlags().Lookup("otel-semconv").Value.Set(sc)
+	}
+
+	root.PersistentFlags().BoolVar(&ecfg.git, "git", false, "[env.BUILDEVENT_GIT] add git.* fields describing the commit checked out in the current directory, such as the author, subject, tags and whether the work tree is dirty")
+	if g, ok := os.LookupEnv("BUILDEVENT_GIT"); ok {
+		root.PersistentFlags().Lookup("git").Value.Set(g)
+	}
+
+	root.PersistentFlags().BoolVar(&ecfg.hostInfo, "host-info", false, "[env.BUILDEVENT_HOST_INFO] add meta.* fields describing the machine the build ran on, such as the hostname, CPU, memory and container limits")
+	if hi, ok := os.LookupEnv("BUILDEVENT_HOST_INFO"); ok {
+		root.PersistentFlags().Lookup("host-info").Value.Set(hi)
+	}
+
+	root.PersistentFlags().StringSliceVar(&ecfg.envPrefixes, "env-prefix", nil, "[env.BUILDEVENT_ENV_PREFIX] add environment variables starting with these prefixes as fields, named by the rest of the variable's name in lowercase, so BUILD_META_TEAM becomes team with a prefix of BUILD_META_")
+	if ep, ok := os.LookupEnv("BUILDEVENT_ENV_PREFIX"); ok {
+		root.PersistentFlags().Lookup("env-prefix").Value.Set(ep)
+	}
+
+	root.PersistentFlags().StringSliceVar(&ecfg.envAllow, "env-allow", nil, "[env.BUILDEVENT_ENV_ALLOW] names or glob patterns of environment variables to add as fields, named by the variable's name in lowercase")
+	if ea, ok := os.LookupEnv("BUILDEVENT_ENV_ALLOW"); ok {
+		root.PersistentFlags().Lookup("env-allow").Value.Set(ea)
+	}
+
+	root.PersistentFlags().StringSliceVar(&ecfg.envDeny, "env-deny", nil, "[env.BUILDEVENT_ENV_DENY] glob patterns of environment variables never to add as fields, in addition to those whose names suggest they hold secrets, such as *TOKEN* and *PASSWORD*")
+	if ed, ok := os.LookupEnv("BUILDEVENT_ENV_DENY"); ok {
+		root.PersistentFlags().Lookup("env-deny").Value.Set(ed)
+	}
+
+	root.PersistentFlags().StringArrayVar(&ecfg.redactPatterns, "redact", nil, "[env.BUILDEVENT_REDACT] a regular expression matching secrets to mask in every field, which may be repeated; the values of environment variables that look like secrets and common GitHub, AWS and Honeycomb token formats are always masked")
+	if rp, ok := os.LookupEnv("BUILDEVENT_REDACT"); ok {
+		root.PersistentFlags().Lookup("redact").Value.Set(rp)
+	}
+
+	root.PersistentFlags().StringVar(&providerMap, "provider-map", "", "[env.BUILDEVENT_PROVIDER_MAP] the path of a YAML or JSON file of CI provider field mappings that add to or override the built in ones")
+	if pmap, ok := os.LookupEnv("BUILDEVENT_PROVIDER_MAP"); ok {
+		root.PersistentFlags().Lookup("provider-map").Value.Set(pmap)
+	}
+
+	root.PersistentFlags().StringVarP(ciProvider, "provider", "p", "", "[env.BUILDEVENT_CIPROVIDER] if unset, will inspect the environment to try to detect common CI providers.")
+	if prov, ok := os.LookupEnv("BUILDEVENT_CIPROVIDER"); ok {
 		root.PersistentFlags().Lookup("provider").Value.Set(prov)
 	}
 
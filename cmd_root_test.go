@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+func TestFieldFileFlag(t *testing.T) {
+	var filename, ciProvider, serviceName string
+
+	ecfg := &eventConfig{}
+	root := commandRoot(&libhoney.Config{}, ecfg, &filename, &ciProvider, &serviceName)
+	err := root.ParseFlags([]string{"--field-file", "results,final.json", "--field-file", "more.env"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"results,final.json", "more.env"}, ecfg.fieldFiles)
+
+	t.Setenv("BUILDEVENT_FIELD_FILES", strings.Join([]string{"a,b.json", "c.env"}, string(filepath.ListSeparator)))
+	ecfg = &eventConfig{}
+	commandRoot(&libhoney.Config{}, ecfg, &filename, &ciProvider, &serviceName)
+	assert.Equal(t, []string{"a,b.json", "c.env"}, ecfg.fieldFiles)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// spanConfig holds the options for sending an arbitrary span
+type spanConfig struct {
+	traceID  string
+	parentID string
+	root     bool
+	spanID   string
+	name     string
+	start    string
+	end      string
+	duration time.Duration
+	status   string
+}
+
+func commandSpan(cfg *libhoney.Config, ecfg *eventConfig, filename *string, ciProvider *string, scfg *spanConfig) *cobra.Command {
+	// SPAN - eg: buildevents span --trace-id $TRAVIS_BUILD_ID --parent-id $STEP_SPAN_ID --name deploy --start $DEPLOY_START
+	spanCmd := &cobra.Command{
+		Use:   "span [flags]",
+		Short: "Sends a span with any parent, name and timing",
+		Long: `
+The span mode sends a single span anywhere in a trace, for stages that don't
+fit the build, step and cmd hierarchy, such as a deploy or waiting for an
+approval. Without --parent-id it is nested under the build's root span, like a
+step, and with --root it is a root span of its own. It prints the span's ID,
+which is generated if --span-id isn't given, so that other spans can be
+nested under it.
+
+--start and --end may be dates (2006-01-02), RFC3339 timestamps, Unix
+timestamps, or durations before now. --end defaults to now, and --start
+defaults to --duration before the end.`,
+		Args:                  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			start, end, err := spanTimes(scfg, time.Now())
+			if err != nil {
+				return err
+			}
+			traceID := strings.TrimSpace(scfg.traceID)
+			parentID, err := spanParent(scfg, traceID)
+			if err != nil {
+				return err
+			}
+			cmd.SilenceUsage = true
+
+			spanID := strings.TrimSpace(scfg.spanID)
+			if spanID == "" {
+				spanBytes := make([]byte, 16)
+				rand.Read(spanBytes)
+				spanID = fmt.Sprintf("%x", spanBytes)
+			}
+
+			ev := createEvent(cfg, ecfg, *ciProvider, traceID)
+			defer sendEvent(ecfg, ev)
+
+			providerInfo(*ciProvider, ev)
+
+			ev.Add(map[string]interface{}{
+				"service_name":  ifClassic(cfg, "span", cfg.Dataset),
+				"service.name":  ifClassic(cfg, "span", cfg.Dataset),
+				"command_name":  "span",
+				"trace.span_id": spanID,
+				"name":          scfg.name,
+				"duration_ms":   end.Sub(start) / time.Millisecond,
+				"source":        "buildevents",
+			})
+			if parentID != "" {
+				ev.AddField("trace.parent_id", parentID)
+			}
+			if scfg.status != "" {
+				ev.AddField("status", scfg.status)
+			}
+			ev.Timestamp = start
+
+			arbitraryFields(ecfg, *filename, ev)
+
+			fmt.Println(spanID)
+			return nil
+		},
+	}
+
+	spanCmd.Flags().StringVar(&scfg.traceID, "trace-id", "", "the trace to add the span to, usually the BUILD_ID passed to the other commands")
+	spanCmd.Flags().StringVar(&scfg.parentID, "parent-id", "", "the ID of the span to nest this one under (default the build's root span, which has the --trace-id as its ID)")
+	spanCmd.Flags().BoolVar(&scfg.root, "root", false, "send a root span with no parent, instead of nesting it under the build")
+	spanCmd.Flags().StringVar(&scfg.spanID, "span-id", "", "the ID of this span (default a random ID)")
+	spanCmd.Flags().StringVar(&scfg.name, "name", "", "the name of the span")
+	spanCmd.Flags().StringVar(&scfg.start, "start", "", "when the span started (default --duration before the end)")
+	spanCmd.Flags().StringVar(&scfg.end, "end", "", "when the span ended (default now)")
+	spanCmd.Flags().DurationVar(&scfg.duration, "duration", 0, "how long the span took, instead of --start or --end")
+	spanCmd.Flags().StringVar(&scfg.status, "status", "", "the status of the span, such as success or failure")
+	spanCmd.MarkFlagRequired("trace-id")
+	spanCmd.MarkFlagRequired("name")
+	return spanCmd
+}
+
+// spanParent returns the ID of the span's parent, which is the build's root
+// span unless another parent is given, or none if it's a root span itself
+func spanParent(scfg *spanConfig, traceID string) (string, error) {
+	parentID := strings.TrimSpace(scfg.parentID)
+	if scfg.root {
+		if parentID != "" {
+			return "", fmt.Errorf("--root and --parent-id may not both be given")
+		}
+		return "", nil
+	}
+	if parentID == "" {
+		return traceID, nil
+	}
+	return parentID, nil
+}
+
+// spanTimes works out when the span started and ended from the flags. Any two
+// of start, end and duration may be given. Relative times are before now.
+func spanTimes(scfg *spanConfig, now time.Time) (time.Time, time.Time, error) {
+	if scfg.start != "" && scfg.end != "" && scfg.duration != 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("only two of --start, --end and --duration may be given")
+	}
+	if scfg.duration < 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("--duration must not be negative")
+	}
+
+	var start, end time.Time
+	var err error
+	if scfg.start != "" {
+		if start, err = parseSince(scfg.start, now); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --start: %w", err)
+		}
+	}
+	if scfg.end != "" {
+		if end, err = parseSince(scfg.end, now); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --end: %w", err)
+		}
+	}
+
+	switch {
+	case scfg.start != "" && scfg.end != "":
+	case scfg.start != "" && scfg.duration != 0:
+		end = start.Add(scfg.duration)
+	case scfg.start != "":
+		end = now
+	case scfg.end != "":
+		start = end.Add(-scfg.duration)
+	default:
+		end = now
+		start = end.Add(-scfg.duration)
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("the span ends before it starts")
+	}
+	return start, end, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanTimes(t *testing.T) {
+	now := time.Unix(1700000600, 0)
+	testCases := []struct {
+		desc  string
+		scfg  spanConfig
+		start int64
+		end   int64
+	}{
+		{"defaults to an instant now", spanConfig{}, 1700000600, 1700000600},
+		{"start until now", spanConfig{start: "1700000000"}, 1700000000, 1700000600},
+		{"start and end", spanConfig{start: "1700000000", end: "2023-11-14T22:15:00Z"}, 1700000000, 1700000100},
+		{"start and duration", spanConfig{start: "1700000000", duration: time.Minute}, 1700000000, 1700000060},
+		{"end and duration", spanConfig{end: "1700000300", duration: time.Minute}, 1700000240, 1700000300},
+		{"duration until now", spanConfig{duration: time.Minute}, 1700000540, 1700000600},
+		{"relative start and end", spanConfig{start: "10m", end: "5m"}, 1700000000, 1700000300},
+		{"date start until now", spanConfig{start: "2023-11-14"}, 1699920000, 1700000600},
+		{"relative start until now", spanConfig{start: "90s"}, 1700000510, 1700000600},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			start, end, err := spanTimes(&tC.scfg, now)
+			require.NoError(t, err)
+			assert.Equal(t, tC.start, start.Unix())
+			assert.Equal(t, tC.end, end.Unix())
+		})
+	}
+
+	for _, bad := range []spanConfig{
+		{start: "1700000000", end: "1700000100", duration: time.Minute},
+		{start: "1700000100", end: "1700000000"},
+		{start: "yesterday"},
+		{end: "tomorrow"},
+		{duration: -time.Minute},
+	} {
+		_, _, err := spanTimes(&bad, now)
+		assert.Error(t, err, "%+v", bad)
+	}
+}
+
+func TestSpanParent(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		scfg   spanConfig
+		expect string
+	}{
+		{"defaults to the build", spanConfig{}, "build-1"},
+		{"explicit parent", spanConfig{parentID: " step-1 "}, "step-1"},
+		{"root span", spanConfig{root: true}, ""},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			parentID, err := spanParent(&tC.scfg, "build-1")
+			require.NoError(t, err)
+			assert.Equal(t, tC.expect, parentID)
+		})
+	}
+
+	_, err := spanParent(&spanConfig{root: true, parentID: "step-1"}, "build-1")
+	assert.Error(t, err)
+}
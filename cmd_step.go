@@ -9,15 +9,17 @@ import (
 	libhoney "github.com/honeycombio/libhoney-go"
 )
 
-func commandStep(cfg *libhoney.Config, filename *string, ciProvider *string) *cobra.Command {
+func commandStep(cfg *libhoney.Config, ecfg *eventConfig, filename *string, ciProvider *string, dcfg *diffConfig, qcfg *queueConfig) *cobra.Command {
 	// STEP - eg: buildevents step $TRAVIS_BUILD_ID $STAGE_SPAN_ID $STAGE_START script
+	var parent string
 	stepCmd := &cobra.Command{
 		Use:   "step [flags] BUILD_ID STEP_ID START_TIME NAME",
 		Short: "Joins a collection of individual commands",
 		Long: `
 The step mode represents a block of related commands. In Travis-CI, this is
 one of "install", "before_script", "script", and so on. In CircleCI, this
-most closely maps to a single job. It should be run at the end of the step.`,
+most closely maps to a single job. It should be run at the end of the step.
+Steps can be nested under other steps with --parent.`,
 		Args:                  cobra.ExactArgs(4),
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -26,13 +28,19 @@ most closely maps to a single job. It should be run at the end of the step.`,
 			startTime := parseUnix(strings.TrimSpace(args[2]))
 			name := strings.TrimSpace(args[3])
 
-			ev := createEvent(cfg, *ciProvider, traceID)
-			defer ev.Send()
+			ev := createEvent(cfg, ecfg, *ciProvider, traceID)
+			defer sendEvent(ecfg, ev)
 
 			providerInfo(*ciProvider, ev)
 
+			// steps are children of the build unless nested under another span
+			parentID := traceID
+			if p := strings.TrimSpace(parent); p != "" {
+				parentID = p
+			}
+
 			ev.Add(map[string]interface{}{
-				"trace.parent_id": traceID,
+				"trace.parent_id": parentID,
 				"trace.span_id":   stepID,
 				"service_name":    ifClassic(cfg, "step", cfg.Dataset),
 				"service.name":    ifClassic(cfg, "step", cfg.Dataset),
@@ -43,10 +51,15 @@ most closely maps to a single job. It should be run at the end of the step.`,
 			})
 			ev.Timestamp = startTime
 
-			arbitraryFields(*filename, ev)
+			diffInfo(dcfg, ev)
+			queueInfo(cfg, ecfg, qcfg, *ciProvider, traceID, stepID, ev)
+			arbitraryFields(ecfg, *filename, ev)
 
 			return nil
 		},
 	}
+	stepCmd.Flags().StringVar(&parent, "parent", "", "the ID of the span to nest this step under, such as another step's STEP_ID (default the build's root span)")
+	addDiffFlags(stepCmd, dcfg)
+	addQueueFlags(stepCmd, qcfg)
 	return stepCmd
 }
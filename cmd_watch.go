@@ -2,36 +2,77 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net/http"
 	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	circleci "github.com/jszwedko/go-circleci"
 	"github.com/spf13/cobra"
 
 	libhoney "github.com/honeycombio/libhoney-go"
 )
 
-// numChecks is the number of times to verify that we're finished before
-// declaring success in case we enter a transient state with blocked jobs that
-// really will start soon. This can be long - wait for up to 2 minutes (5sec *
-// 24 = 120sec). It's ok for this to be long because it only covers the time
-// when there are existing jobs that are not going to run. Most builds finish
-// with all jobs finishing, so this timer will not caused delayed builds in
-// those cases.
-const numChecks = 24
+// defaultSettleChecks is the number of times to verify that we're finished
+// before declaring success in case we enter a transient state with blocked jobs
+// that really will start soon. This can be long - wait for up to 2 minutes
+// (5sec * 24 = 120sec). It's ok for this to be long because it only covers the
+// time when there are existing jobs that are not going to run. Most builds
+// finish with all jobs finishing, so this timer will not caused delayed builds
+// in those cases.
+const defaultSettleChecks = 24
+
+// defaultPollInterval is how long to wait between polls of the CircleCI API
+// when everything is going well.
+const defaultPollInterval = 5 * time.Second
+
+// workflowFetchAttempts is the number of times we'll try to fetch the workflow
+// itself before giving up when the CircleCI API returns retryable errors.
+const workflowFetchAttempts = 5
 
 type watchConfig struct {
-	timeoutMin int
-	circleKey  string
-	workflowID string
-	jobName    string
+	timeoutMin   int
+	circleKey    string
+	workflowID   string
+	jobName      string
+	pollInterval time.Duration
+	settleChecks int
+	maxBackoff   time.Duration
+	// timeoutOutcome is the status to report when we give up waiting
+	timeoutOutcome string
+	// waitFor and ignore are glob patterns of job names that narrow down
+	// which jobs we wait for
+	waitFor []string
+	ignore  []string
+	// circleAPI overrides the base URL of the CircleCI API, for tests
+	circleAPI string
+}
+
+// watchResult describes the outcome of watching a workflow
+type watchResult struct {
+	passed     bool
+	started    time.Time
+	ended      time.Time
+	jobsFailed []string
+	// jobsBlocked lists the jobs that were still blocked when we stopped
+	// watching
+	jobsBlocked []string
+	timedOut    bool
+	// polls is the number of times we asked the CircleCI API for the jobs in
+	// the workflow, and apiErrors how many of those failed
+	polls     int
+	apiErrors int
+	// settleDuration is how long we spent waiting for blocked jobs to start
+	// after nothing was left running
+	settleDuration time.Duration
 }
 
-func commandWatch(cfg *libhoney.Config, filename *string, ciProvider *string, wcfg *watchConfig) *cobra.Command {
+func commandWatch(cfg *libhoney.Config, ecfg *eventConfig, filename *string, ciProvider *string, wcfg *watchConfig) *cobra.Command {
 	// WATCH eg: buildevents watch $TRAVIS_BUILD_ID
 	watchCmd := &cobra.Command{
 		Use:   "watch BUILD_ID",
@@ -43,47 +84,64 @@ build with the appropriate timers.`,
 		Args: cobra.MatchAll(
 			cobra.ExactArgs(1),
 			func(cmd *cobra.Command, args []string) error {
-				if *ciProvider != providerCircle {
-					return fmt.Errorf("watch command only valid for %s", providerCircle)
+				if wcfg.timeoutOutcome != "failure" && wcfg.timeoutOutcome != "unknown" {
+					return fmt.Errorf("timeout-outcome must be one of [failure unknown]")
+				}
+				for _, pattern := range append(wcfg.waitFor, wcfg.ignore...) {
+					if _, err := path.Match(pattern, ""); err != nil {
+						return fmt.Errorf("invalid job name pattern %q: %w", pattern, err)
+					}
 				}
 				return nil
 			},
 		),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			// the provider is detected after argument validation, so check it
+			// here
+			if canonicalProvider(*ciProvider) != providerCircle {
+				return fmt.Errorf("watch command only valid for %s", providerCircle)
+			}
 			traceID := strings.TrimSpace(args[0])
 
-			ev := createEvent(cfg, *ciProvider, traceID)
-			defer ev.Send()
+			ev := createEvent(cfg, ecfg, *ciProvider, traceID)
+			defer sendEvent(ecfg, ev)
 
 			providerInfo(*ciProvider, ev)
 
-			ok, startTime, endTime, jobsFailed, err := waitCircle(context.Background(), *wcfg)
+			res, err := waitCircle(context.Background(), *wcfg)
 			if err != nil {
 				fmt.Printf("buildevents - Error detected: %s\n", err.Error())
 				return err
 			}
 
 			status := "failed"
-			if ok {
+			if res.passed {
 				status = "success"
+			} else if res.timedOut && wcfg.timeoutOutcome == "unknown" {
+				status = "unknown"
 			}
 
 			ev.Add(map[string]interface{}{
-				"service_name":  ifClassic(cfg, "watch", cfg.Dataset),
-				"service.name":  ifClassic(cfg, "watch", cfg.Dataset),
-				"command_name":  "watch",
-				"trace.span_id": traceID,
-				"name":          ifClassic(cfg, "watch "+traceID, "watch"),
-				"status":        status,
-				"duration_ms":   endTime.Sub(startTime) / time.Millisecond,
-				"source":        "buildevents",
-				"jobs_failed":   strings.Join(jobsFailed, ","),
+				"service_name":       ifClassic(cfg, "watch", cfg.Dataset),
+				"service.name":       ifClassic(cfg, "watch", cfg.Dataset),
+				"command_name":       "watch",
+				"trace.span_id":      traceID,
+				"name":               ifClassic(cfg, "watch "+traceID, "watch"),
+				"status":             status,
+				"duration_ms":        res.ended.Sub(res.started) / time.Millisecond,
+				"source":             "buildevents",
+				"jobs_failed":        strings.Join(res.jobsFailed, ","),
+				"jobs_blocked":       strings.Join(res.jobsBlocked, ","),
+				"timed_out":          res.timedOut,
+				"polls":              res.polls,
+				"api_errors":         res.apiErrors,
+				"settle_duration_ms": res.settleDuration / time.Millisecond,
 			})
-			ev.Timestamp = startTime
+			ev.Timestamp = res.started
 
-			arbitraryFields(*filename, ev) // TODO: consider - move this until after the watch timeout??
+			arbitraryFields(ecfg, *filename, ev) // TODO: consider - move this until after the watch timeout??
 
-			url, err := buildURL(cfg, traceID, startTime.Unix())
+			url, err := buildURL(cfg, traceID, res.started.Unix())
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Unable to create trace URL: %v\n", err)
 			} else {
@@ -116,26 +174,85 @@ build with the appropriate timers.`,
 		watchCmd.Flags().Lookup("jobname").Value.Set(jnm)
 	}
 
+	watchCmd.Flags().StringVar(&wcfg.timeoutOutcome, "timeout-outcome", "failure", "[env.BUILDEVENT_TIMEOUT_OUTCOME] status to report if watch times out, one of failure or unknown")
+	if to, ok := os.LookupEnv("BUILDEVENT_TIMEOUT_OUTCOME"); ok {
+		watchCmd.Flags().Lookup("timeout-outcome").Value.Set(to)
+	}
+
+	watchCmd.Flags().StringSliceVar(&wcfg.waitFor, "wait-for", nil, "[env.BUILDEVENT_WAIT_FOR] glob patterns of job names to wait for; if set, all other jobs are ignored")
+	if wf, ok := os.LookupEnv("BUILDEVENT_WAIT_FOR"); ok {
+		watchCmd.Flags().Lookup("wait-for").Value.Set(wf)
+	}
+
+	watchCmd.Flags().StringSliceVar(&wcfg.ignore, "ignore", nil, "[env.BUILDEVENT_IGNORE] glob patterns of job names not to wait for")
+	if ig, ok := os.LookupEnv("BUILDEVENT_IGNORE"); ok {
+		watchCmd.Flags().Lookup("ignore").Value.Set(ig)
+	}
+
+	watchCmd.Flags().DurationVar(&wcfg.pollInterval, "poll-interval", defaultPollInterval, "[env.BUILDEVENT_POLL_INTERVAL] how long to wait between polls of the CircleCI API")
+	if pi, ok := os.LookupEnv("BUILDEVENT_POLL_INTERVAL"); ok {
+		if _, err := time.ParseDuration(pi); err == nil {
+			watchCmd.Flags().Lookup("poll-interval").Value.Set(pi)
+		}
+	}
+
+	watchCmd.Flags().IntVar(&wcfg.settleChecks, "settle-checks", defaultSettleChecks, "[env.BUILDEVENT_SETTLE_CHECKS] number of polls to wait for blocked jobs to start once nothing is running")
+	if sc, ok := os.LookupEnv("BUILDEVENT_SETTLE_CHECKS"); ok {
+		if _, err := strconv.Atoi(sc); err == nil {
+			watchCmd.Flags().Lookup("settle-checks").Value.Set(sc)
+		}
+	}
+
+	watchCmd.Flags().DurationVar(&wcfg.maxBackoff, "max-backoff", 2*time.Minute, "[env.BUILDEVENT_MAX_BACKOFF] longest time to wait between polls when the CircleCI API is returning errors")
+	if mb, ok := os.LookupEnv("BUILDEVENT_MAX_BACKOFF"); ok {
+		if _, err := time.ParseDuration(mb); err == nil {
+			watchCmd.Flags().Lookup("max-backoff").Value.Set(mb)
+		}
+	}
+
 	return watchCmd
 }
 
 // waitCircle polls the CircleCI API checking for the status of this workflow
 // and the jobs it contains. It returns whether the workflow build succeeded,
 // the time it started, and the time it ended (which will be either nowish or
-// sometime in the past if we timed out). The err returned is for errors polling
-// the CircleCI API, not errors in the build itself.
-func waitCircle(parent context.Context, cfg watchConfig) (passed bool, started, ended time.Time, jobsFailed []string, err error) {
+// sometime in the past if we timed out), along with some details about how the
+// watch went. The err returned is for errors polling the CircleCI API, not
+// errors in the build itself.
+func waitCircle(parent context.Context, cfg watchConfig) (res watchResult, err error) {
 	// we need a token to query anything; give a helpful error if we have no token
 	if cfg.circleKey == "" {
-		return false, time.Now(), time.Now().Add(time.Second), nil, fmt.Errorf("circle token required to poll the API")
+		return watchResult{started: time.Now(), ended: time.Now().Add(time.Second)}, fmt.Errorf("circle token required to poll the API")
 	}
-	client := &circleci.Client{Token: cfg.circleKey}
-	wf, err := client.GetWorkflowV2(cfg.workflowID)
-	if err != nil {
-		return false, time.Now(), time.Now().Add(time.Second), nil, err
+	if cfg.pollInterval <= 0 {
+		cfg.pollInterval = defaultPollInterval
+	}
+	if cfg.maxBackoff < cfg.pollInterval {
+		cfg.maxBackoff = cfg.pollInterval
 	}
-	started = wf.CreatedAt
-	ended = time.Now() // set a default in case we early exit
+	client := newCircleClient(cfg.circleKey)
+	if cfg.circleAPI != "" {
+		client.baseURL = cfg.circleAPI
+	}
+	var wf *circleWorkflow
+	for attempt := 1; ; attempt++ {
+		wf, err = client.getWorkflow(cfg.workflowID)
+		if err == nil {
+			break
+		}
+		if attempt >= workflowFetchAttempts || !isRetryable(err) {
+			return watchResult{started: time.Now(), ended: time.Now().Add(time.Second)}, err
+		}
+		delay := pollDelay(cfg, attempt, err)
+		fmt.Printf("Fetching the workflow failed with %s; retrying in %s.\n", err.Error(), delay.Round(time.Millisecond))
+		select {
+		case <-parent.Done():
+			return watchResult{started: time.Now(), ended: time.Now().Add(time.Second)}, parent.Err()
+		case <-time.After(delay):
+		}
+	}
+	res.started = wf.CreatedAt
+	res.ended = time.Now() // set a default in case we early exit
 
 	// set up cancellation timeout based on the configured timout duration
 	done := make(chan struct{})
@@ -146,40 +263,75 @@ func waitCircle(parent context.Context, cfg watchConfig) (passed bool, started,
 	// In that case there are no jobs running and some jobs blocked that could
 	// still run. If we think the build has passed and finished, let's give it a
 	// buffer to spin up new jobs before really considering it done. This buffer
-	// will check for up to 2 minutes
-	checksLeft := numChecks + 1 // +1 because we decrement at the beginning of the loop
+	// will check settleChecks more times.
+	checksLeft := cfg.settleChecks + 1 // +1 because we decrement at the beginning of the loop
+
+	// settleStart is when we first noticed nothing was running; it is zero
+	// while jobs are still running.
+	var settleStart time.Time
+
+	// finish records the final state of the workflow from the last poll
+	finish := func(resp evalWorkflowResponse) {
+		res.passed = !resp.anyFailed
+		if res.passed {
+			fmt.Println("Build passed!")
+		} else {
+			fmt.Println("Build failed!")
+			res.jobsFailed = resp.failedJobs
+		}
+		res.jobsBlocked = resp.blockedJobs
+		if !settleStart.IsZero() {
+			res.settleDuration = time.Since(settleStart)
+		}
+	}
 
 	go func() {
 		defer close(done)
-		tk := time.NewTicker(5 * time.Second).C
-		for range tk {
+		delay := cfg.pollInterval
+		apiErrors := 0
+		var last evalWorkflowResponse
+		for {
 			// check for timeout or pause before the next iteration
 			select {
 			case <-ctx.Done():
-				// TODO add the fact that it timed out to the trace to say why it failed
 				fmt.Fprintf(os.Stderr, "Timeout reached waiting for the workflow to finish\n")
-				ended = time.Now()
+				res.timedOut = true
+				res.passed = false
+				res.ended = time.Now()
+				res.jobsBlocked = last.blockedJobs
+				if !settleStart.IsZero() {
+					res.settleDuration = time.Since(settleStart)
+				}
 				return
-			default:
+			case <-time.After(delay):
 			}
 
-			resp, err := evalWorkflow(client, cfg.workflowID, cfg.jobName)
+			res.polls++
+			resp, err := evalWorkflow(client, cfg)
+			if err != nil {
+				// we previously successfully queried for the workflow; this is
+				// likely a transient error or rate limiting, so back off and try
+				// again without counting this as a check.
+				res.apiErrors++
+				apiErrors++
+				delay = pollDelay(cfg, apiErrors, err)
+				fmt.Printf("Querying the CircleCI API failed with %s; retrying in %s.\n", err.Error(), delay.Round(time.Millisecond))
+				continue
+			}
+			apiErrors = 0
+			delay = cfg.pollInterval
+			last = resp
 
 			if !resp.anyRunning {
 				// if this is the first time we think we're finished store the timestamp
-				if checksLeft >= numChecks {
-					ended = time.Now()
+				if settleStart.IsZero() {
+					res.ended = time.Now()
+					settleStart = res.ended
 				}
 
-				if !resp.anyBlocked && err == nil {
+				if !resp.anyBlocked {
 					// we are legit done.
-					passed = !resp.anyFailed
-					if passed {
-						fmt.Println("Build passed!")
-					} else {
-						fmt.Println("Build failed!")
-						jobsFailed = resp.failedJobs
-					}
+					finish(resp)
 					return
 				}
 
@@ -187,26 +339,13 @@ func waitCircle(parent context.Context, cfg watchConfig) (passed bool, started,
 				checksLeft--
 				if checksLeft <= 0 {
 					// we're done checking.
-					passed = !resp.anyFailed
-					if passed {
-						fmt.Println("Build passed!")
-					} else {
-						fmt.Println("Build failed!")
-						jobsFailed = resp.failedJobs
-					}
+					finish(resp)
 					return
 				}
-				if err != nil {
-					// we previously successfully queried for the workflow; this is likely a
-					// transient error
-					fmt.Printf("Querying the CirlceCI API failed with %s; trying %d more times before giving up.\n", err.Error(), checksLeft)
-					continue
-				}
 				if resp.anyFailed {
 					// don't bother rechecking if a job has failed
-					fmt.Printf("Build failed!\n")
-					jobsFailed = resp.failedJobs
-					ended = time.Now()
+					finish(resp)
+					res.ended = time.Now()
 					return
 				}
 				// yay looks like maybe we're done?
@@ -214,15 +353,55 @@ func waitCircle(parent context.Context, cfg watchConfig) (passed bool, started,
 				continue
 			}
 			// if we previously thought we were finished but now realize we weren't,
-			// reset the check counter so we try 3 times again next time we think we're
+			// reset the check counter so we try again next time we think we're
 			// finished.
-			passed = false
-			checksLeft = numChecks
+			res.passed = false
+			checksLeft = cfg.settleChecks
+			settleStart = time.Time{}
 		}
 	}()
 
 	<-done
-	return passed, started, ended, jobsFailed, nil
+	return res, nil
+}
+
+// pollDelay returns how long to wait before the next poll after the given
+// number of consecutive API errors. If the API told us how long to wait, we
+// honor that; otherwise we back off exponentially from the poll interval up to
+// the configured maximum, with jitter so that many concurrent watchers don't
+// retry in lockstep.
+func pollDelay(cfg watchConfig, consecutiveErrors int, err error) time.Duration {
+	if consecutiveErrors <= 0 {
+		return cfg.pollInterval
+	}
+	var apiErr *circleAPIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		if apiErr.RetryAfter < cfg.pollInterval {
+			return cfg.pollInterval
+		}
+		return apiErr.RetryAfter
+	}
+
+	backoff := cfg.pollInterval
+	for i := 0; i < consecutiveErrors && backoff < cfg.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > cfg.maxBackoff {
+		backoff = cfg.maxBackoff
+	}
+	// wait somewhere between half and all of the backoff
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// isRetryable returns true if the error from the CircleCI API is one that may
+// go away if we wait and try again.
+func isRetryable(err error) bool {
+	var apiErr *circleAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	// network errors and the like
+	return true
 }
 
 type evalWorkflowResponse struct {
@@ -230,15 +409,18 @@ type evalWorkflowResponse struct {
 	anyFailed  bool
 	anyBlocked bool
 	failedJobs []string
+	// blockedJobs lists the jobs that are waiting on something before they
+	// can run
+	blockedJobs []string
 }
 
 // evalWorkflow looks at the CircleCI API for the list of jobs in this workflow
 // and decides whether the build has finished and if finished, whether it
 // failed. If an error is returned, it represents an error talking to the
 // CircleCI API, not an error with the workflow.
-func evalWorkflow(client *circleci.Client, wfID string, jobName string) (evalWorkflowResponse, error) {
+func evalWorkflow(client *circleClient, cfg watchConfig) (evalWorkflowResponse, error) {
 	fmt.Printf("%s: polling for jobs: ", time.Now().Format(time.StampMilli))
-	wfJobs, err := getJobs(client, wfID)
+	wfJobs, err := getJobs(client, cfg.workflowID)
 	if err != nil {
 		fmt.Printf("error polling: %s\n", err.Error())
 		return evalWorkflowResponse{
@@ -248,11 +430,16 @@ func evalWorkflow(client *circleci.Client, wfID string, jobName string) (evalWor
 	}
 	fmt.Println(summarizeJobList(wfJobs))
 
+	return evalJobs(wfJobs, cfg), nil
+}
+
+// evalJobs decides whether the jobs we're watching have finished and if
+// finished, whether any of them failed.
+func evalJobs(wfJobs []*circleJob, cfg watchConfig) evalWorkflowResponse {
 	// defaults all to false
 	resp := evalWorkflowResponse{}
 	for _, job := range wfJobs {
-		// skip ourself so we don't wait if we're the only job running
-		if job.Name == jobName {
+		if !watchingJob(cfg, job.Name) {
 			continue
 		}
 
@@ -265,6 +452,7 @@ func evalWorkflow(client *circleci.Client, wfID string, jobName string) (evalWor
 			// it's waiting on a running job, depends on a failed job, or
 			// it's not configured to run this build (because of a tag or something)
 			resp.anyBlocked = true
+			resp.blockedJobs = append(resp.blockedJobs, job.Name)
 			continue
 		case "not_running":
 			// not_running is the same as queued
@@ -282,31 +470,59 @@ func evalWorkflow(client *circleci.Client, wfID string, jobName string) (evalWor
 		}
 	}
 
-	return resp, nil
+	return resp
 }
 
-// getJobs queries the CircleCI API for a list of all jobs in the current workflow
-func getJobs(client *circleci.Client, wfID string) ([]*circleci.WorkflowJob, error) {
-	// get the list of jobs, paging if necessary
-	wfJobs, more, err := client.ListWorkflowV2Jobs(wfID, nil)
-	if err != nil {
-		return nil, err
+// watchingJob returns true if the named job is one whose outcome decides
+// whether the build has finished. We always skip ourself so we don't wait if
+// we're the only job running. If any --wait-for patterns were given the job
+// must match one of them, and it must not match any --ignore pattern.
+func watchingJob(cfg watchConfig, name string) bool {
+	if name == cfg.jobName {
+		return false
 	}
-	for more != nil {
-		// TODO only print this in debug mode
-		fmt.Printf("getting more jobs! next page is %s\n", *more)
-		var moreJobs []*circleci.WorkflowJob
-		moreJobs, more, err = client.ListWorkflowV2Jobs(wfID, nil)
+	if len(cfg.waitFor) > 0 && !matchAny(cfg.waitFor, name) {
+		return false
+	}
+	return !matchAny(cfg.ignore, name)
+}
+
+// matchAny returns true if the name matches any of the glob patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getJobs queries the CircleCI API for a list of all jobs in the current
+// workflow, following the next page token until every page has been fetched.
+func getJobs(client *circleClient, wfID string) ([]*circleJob, error) {
+	var wfJobs []*circleJob
+	seen := map[string]bool{}
+	pageToken := ""
+	for page := 0; page < maxJobPages; page++ {
+		jobs, next, err := client.listWorkflowJobs(wfID, pageToken)
 		if err != nil {
 			return nil, err
 		}
-		wfJobs = append(wfJobs, moreJobs...)
+		wfJobs = append(wfJobs, jobs...)
+		if next == "" {
+			return wfJobs, nil
+		}
+		if seen[next] {
+			return nil, fmt.Errorf("CircleCI API returned page token %q more than once", next)
+		}
+		seen[next] = true
+		pageToken = next
 	}
-	return wfJobs, nil
+	return nil, fmt.Errorf("workflow %s has more than %d pages of jobs", wfID, maxJobPages)
 }
 
 // summarizeJobList takes a list of jobs and returns a string summary
-func summarizeJobList(wfJobs []*circleci.WorkflowJob) string {
+func summarizeJobList(wfJobs []*circleJob) string {
 	if len(wfJobs) == 0 {
 		return "no jobs found"
 	}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollDelay(t *testing.T) {
+	cfg := watchConfig{
+		pollInterval: 5 * time.Second,
+		maxBackoff:   time.Minute,
+	}
+
+	assert.Equal(t, cfg.pollInterval, pollDelay(cfg, 0, nil))
+
+	// exponential backoff stays between half and all of the capped backoff
+	for errs, want := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		4:  time.Minute,
+		10: time.Minute,
+	} {
+		for i := 0; i < 20; i++ {
+			d := pollDelay(cfg, errs, errors.New("boom"))
+			assert.GreaterOrEqual(t, d, want/2)
+			assert.LessOrEqual(t, d, want)
+		}
+	}
+
+	// Retry-After is honored, but never shorter than the poll interval
+	rateLimited := &circleAPIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 30 * time.Second}
+	assert.Equal(t, 30*time.Second, pollDelay(cfg, 1, rateLimited))
+	rateLimited.RetryAfter = time.Second
+	assert.Equal(t, cfg.pollInterval, pollDelay(cfg, 1, rateLimited))
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(&circleAPIError{StatusCode: http.StatusTooManyRequests}))
+	assert.True(t, isRetryable(&circleAPIError{StatusCode: http.StatusBadGateway}))
+	assert.False(t, isRetryable(&circleAPIError{StatusCode: http.StatusNotFound}))
+	assert.True(t, isRetryable(errors.New("connection reset by peer")))
+}
+
+func TestEvalJobs(t *testing.T) {
+	jobs := []*circleJob{
+		{Name: "setup", Status: "success"},
+		{Name: "send_trace", Status: "running"},
+		{Name: "test_go", Status: "success"},
+		{Name: "test_js", Status: "failed"},
+		{Name: "deploy", Status: "blocked"},
+		{Name: "fuzz_nightly", Status: "running"},
+	}
+
+	testCases := []struct {
+		Name    string
+		WaitFor []string
+		Ignore  []string
+		Running bool
+		Failed  []string
+		Blocked []string
+	}{
+		{Name: "all jobs", Running: true, Failed: []string{"test_js"}, Blocked: []string{"deploy"}},
+		{Name: "ignore fuzzers", Ignore: []string{"fuzz_*"}, Failed: []string{"test_js"}, Blocked: []string{"deploy"}},
+		{Name: "wait for tests", WaitFor: []string{"test_*"}, Failed: []string{"test_js"}},
+		{Name: "wait for and ignore", WaitFor: []string{"test_*", "fuzz_*"}, Ignore: []string{"test_js"}, Running: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := watchConfig{jobName: "send_trace", waitFor: tc.WaitFor, ignore: tc.Ignore}
+			resp := evalJobs(jobs, cfg)
+			assert.Equal(t, tc.Running, resp.anyRunning)
+			assert.Equal(t, len(tc.Failed) > 0, resp.anyFailed)
+			assert.Equal(t, tc.Failed, resp.failedJobs)
+			assert.Equal(t, len(tc.Blocked) > 0, resp.anyBlocked)
+			assert.Equal(t, tc.Blocked, resp.blockedJobs)
+		})
+	}
+}
+
+// fakeCircleWorkflow serves a workflow whose jobs change with each poll,
+// staying in the last state once it runs out. It records when each poll of the
+// jobs happened.
+func fakeCircleWorkflow(t *testing.T, polls [][]string) (*httptest.Server, func() []time.Time) {
+	var mu sync.Mutex
+	var times []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/workflow/wf-1":
+			fmt.Fprint(w, `{"id":"wf-1","created_at":"2024-01-02T03:04:05Z"}`)
+		case "/api/v2/workflow/wf-1/job":
+			mu.Lock()
+			statuses := polls[len(polls)-1]
+			if len(times) < len(polls) {
+				statuses = polls[len(times)]
+			}
+			times = append(times, time.Now())
+			mu.Unlock()
+
+			items := ""
+			for i, status := range statuses {
+				if i > 0 {
+					items += ","
+				}
+				items += fmt.Sprintf(`{"id":"job-%d","name":"job_%d","status":%q}`, i, i, status)
+			}
+			fmt.Fprintf(w, `{"items":[%s],"next_page_token":null}`, items)
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]time.Time(nil), times...)
+	}
+}
+
+func TestWaitCircle(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	running := []string{"success", "running"}
+	settling := []string{"success", "blocked"}
+	finished := []string{"success", "success"}
+
+	t.Run("settle then finish", func(t *testing.T) {
+		server, polled := fakeCircleWorkflow(t, [][]string{settling, settling, finished})
+		defer server.Close()
+
+		cfg := watchConfig{circleKey: "token", workflowID: "wf-1", timeoutMin: 1, pollInterval: interval, settleChecks: 5, circleAPI: server.URL + "/api/v2/"}
+		res, err := waitCircle(context.Background(), cfg)
+		require.NoError(t, err)
+		assert.True(t, res.passed)
+		assert.False(t, res.timedOut)
+		assert.Equal(t, 3, res.polls)
+		assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), res.started.UTC())
+
+		// settling started at the first idle poll, not the second
+		times := polled()
+		assert.GreaterOrEqual(t, res.settleDuration, times[2].Sub(times[1])+interval/2)
+		assert.True(t, res.ended.Before(times[1]), "ended %v should be before the second idle poll at %v", res.ended, times[1])
+	})
+
+	t.Run("settle then running again then finish", func(t *testing.T) {
+		server, polled := fakeCircleWorkflow(t, [][]string{settling, running, settling, finished})
+		defer server.Close()
+
+		cfg := watchConfig{circleKey: "token", workflowID: "wf-1", timeoutMin: 1, pollInterval: interval, settleChecks: 5, circleAPI: server.URL + "/api/v2/"}
+		res, err := waitCircle(context.Background(), cfg)
+		require.NoError(t, err)
+		assert.True(t, res.passed)
+		assert.Equal(t, 4, res.polls)
+
+		// settling restarted when the jobs ran again
+		times := polled()
+		assert.Greater(t, res.settleDuration, time.Duration(0))
+		assert.Less(t, res.settleDuration, times[3].Sub(times[1]))
+		assert.True(t, res.ended.After(times[2]), "ended %v should be after the last settling poll at %v", res.ended, times[2])
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		server, _ := fakeCircleWorkflow(t, [][]string{running})
+		defer server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 4*interval)
+		defer cancel()
+		cfg := watchConfig{circleKey: "token", workflowID: "wf-1", timeoutMin: 1, pollInterval: interval, settleChecks: 5, circleAPI: server.URL + "/api/v2/"}
+		res, err := waitCircle(ctx, cfg)
+		require.NoError(t, err)
+		assert.True(t, res.timedOut)
+		assert.False(t, res.passed)
+		assert.Greater(t, res.polls, 0)
+		assert.Equal(t, time.Duration(0), res.settleDuration)
+	})
+}
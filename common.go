@@ -12,13 +12,60 @@ import (
 	"strings"
 	"time"
 
-	"github.com/kr/logfmt"
-
 	libhoney "github.com/honeycombio/libhoney-go"
 	"github.com/honeycombio/libhoney-go/transmission"
 )
 
-func createEvent(cfg *libhoney.Config, provider string, traceID string) *libhoney.Event {
+// eventConfig holds the options that change which fields are added to every
+// event, no matter which command sends it
+type eventConfig struct {
+	// otelSemconv adds OpenTelemetry semantic convention attributes
+	otelSemconv bool
+	// fileFormat is the format of the arbitrary fields files; if empty it is
+	// chosen by each file's extension
+	fileFormat string
+	// typedFields stops values that only look like numbers or booleans
+	// being turned in to them
+	typedFields bool
+	// fieldSchema is the path of a file declaring the types of fields; it
+	// implies typedFields
+	fieldSchema string
+	// fieldFiles are more files of arbitrary fields, read after the main one
+	fieldFiles []string
+	// fields are key=val fields given on the command line
+	fields []string
+	// envPrefixes and envAllow select environment variables to add as
+	// fields, unless they match envDeny or the default deny list
+	envPrefixes []string
+	envAllow    []string
+	envDeny     []string
+	// redactPatterns are regular expressions matching secrets to mask, in
+	// addition to the built in ones
+	redactPatterns []string
+	// redactor masks secrets in outgoing events
+	redactor *redactor
+	// git adds fields describing the git repository in the current directory
+	git bool
+	// hostInfo adds fields describing the machine the build is running on
+	hostInfo bool
+}
+
+func createEvent(cfg *libhoney.Config, ecfg *eventConfig, provider string, traceID string) *libhoney.Event {
+	initLibhoney(cfg, provider)
+	ev := newEvent(provider, traceID)
+	if ecfg.hostInfo {
+		ev.Add(hostInfo(os.DirFS("/"), os.LookupEnv))
+	}
+	ev.Add(envFields(ecfg, os.Environ()))
+	if ecfg.git {
+		ev.Add(gitInfo("."))
+	}
+	return ev
+}
+
+// initLibhoney sets up libhoney to send events. If there's no API key, events
+// are written to STDOUT instead.
+func initLibhoney(cfg *libhoney.Config, provider string) {
 	libhoney.UserAgentAddition = fmt.Sprintf("buildevents/%s", Version)
 	if provider != "" {
 		libhoney.UserAgentAddition += fmt.Sprintf(" (%s)", provider)
@@ -28,7 +75,11 @@ func createEvent(cfg *libhoney.Config, provider string, traceID string) *libhone
 		cfg.Transmission = &transmission.WriterSender{}
 	}
 	libhoney.Init(*cfg)
+}
 
+// newEvent creates an event with the fields common to every span, without
+// (re)initializing libhoney.
+func newEvent(provider string, traceID string) *libhoney.Event {
 	ev := libhoney.NewEvent()
 	if provider != "" {
 		ev.AddField("ci_provider", provider)
@@ -42,141 +93,87 @@ func createEvent(cfg *libhoney.Config, provider string, traceID string) *libhone
 	return ev
 }
 
+// sendEvent finishes off the event according to the event config and sends it
+func sendEvent(ecfg *eventConfig, ev *libhoney.Event) {
+	if ecfg.otelSemconv {
+		addSemconvFields(ev)
+	}
+	// this must come last, so nothing can add a secret after it
+	if ecfg.redactor != nil {
+		ecfg.redactor.redact(ev)
+	}
+	ev.Send()
+}
+
 // providerInfo adds a bunch of fields to every span with useful information
 // about the build, gleaned from known providers
 func providerInfo(provider string, ev *libhoney.Event) {
-	// envVars is a map of environment variable to event field name
-	var envVars map[string]string
-	switch strings.ToLower(provider) {
-	case "circleci", "circle-ci", "circle":
-		envVars = map[string]string{
-			"CIRCLE_BRANCH":         "branch",
-			"CIRCLE_BUILD_NUM":      "build_num",
-			"CIRCLE_BUILD_URL":      "build_url", // overwrites buildevent_url+traceID
-			"CIRCLE_JOB":            "job_name",
-			"CIRCLE_PR_NUMBER":      "pr_number",
-			"CIRCLE_PR_REPONAME":    "pr_repo",
-			"CIRCLE_PR_USER":        "pr_user",
-			"CIRCLE_REPOSITORY_URL": "repo",
-		}
-	case "travis-ci", "travisci", "travis":
-		envVars = map[string]string{
-			"TRAVIS_BRANCH":              "branch",
-			"TRAVIS_BUILD_NUMBER":        "build_num",
-			"TRAVIS_BUILD_WEB_URL":       "build_url",
-			"TRAVIS_PULL_REQUEST":        "pr_number",
-			"TRAVIS_PULL_REQUEST_BRANCH": "pr_branch",
-			"TRAVIS_PULL_REQUEST_SLUG":   "pr_repo",
-			"TRAVIS_REPO_SLUG":           "repo",
-		}
-	case "gitlab-ci", "gitlabci", "gitlab":
-		envVars = map[string]string{
-			"CI_COMMIT_REF_NAME":                   "branch",
-			"CI_PIPELINE_ID":                       "build_num",
-			"CI_PIPELINE_URL":                      "build_url",
-			"CI_MERGE_REQUEST_ID":                  "pr_number",
-			"CI_MERGE_REQUEST_SOURCE_BRANCH_NAME":  "pr_branch",
-			"CI_MERGE_REQUEST_SOURCE_PROJECT_PATH": "pr_repo",
-			"CI_PROJECT_URL":                       "repo",
-		}
-
-	case "buildkite", "buildkiteci", "build-kite":
-		envVars = map[string]string{
-			"BUILDKITE_BRANCH":            "branch",
-			"BUILDKITE_BUILD_NUMBER":      "build_num",
-			"BUILDKITE_BUILD_URL":         "build_url",
-			"BUILDKITE_PULL_REQUEST":      "pr_number",
-			"BUILDKITE_PULL_REQUEST_REPO": "pr_repo",
-			"BUILDKITE_REPO":              "repo",
-		}
-	case "jenkinsx", "jenkins-x":
-		envVars = map[string]string{
-			"BRANCH_NAME":  "branch",
-			"BUILD_NUMBER": "build_num",
-			"PULL_NUMBER":  "pr_number",
-			"REPO_NAME":    "repo",
-		}
-
-	case "google-cloud-build", "cloud-build", "gcb":
-		envVars = map[string]string{
-			"BRANCH_NAME": "branch",
-			"BUILD_ID":    "build_num",
-			"HEAD_BRANCH": "pr_branch",
-			"REPO_OWNER":  "pr_user",
-			"REPO_NAME":   "repo",
-		}
-
-	case "azure-pipelines", "azure-devops", "vsts", "tfs":
-		envVars = map[string]string{
-			"BUILD_SOURCEBRANCHNAME":               "branch",
-			"BUILD_BUILDID":                        "build_id",
-			"BUILD_BUILDNUMBER":                    "build_number",
-			"SYSTEM_JOBDISPLAYNAME":                "job_name",
-			"SYSTEM_STAGEDISPLAYNAME":              "stage_name",
-			"SYSTEM_PULLREQUEST_PULLREQUESTID":     "pr_id",
-			"SYSTEM_PULLREQUEST_PULLREQUESTNUMBER": "pr_number",
-			"SYSTEM_PULLREQUEST_SOURCEBRANCH":      "pr_branch",
-			"BUILD_REQUESTEDFOR":                   "build_user",
-			"BUILD_REPOSITORY_URI":                 "repo",
-		}
+	def := lookupProvider(provider)
+	if def == nil {
+		return
+	}
+	for _, f := range providerFields(def, os.LookupEnv) {
+		ev.AddField(f.name, f.value)
+	}
+	if enrich, ok := providerEnrichers[def.Name]; ok {
+		enrich(ev)
+	}
+}
 
-	case "github-actions", "githubactions", "github", "gha-buildevents":
-		envVars = map[string]string{
-			"GITHUB_REF":        "branch",
-			"GITHUB_RUN_ID":     "build_num",
-			"GITHUB_WORKFLOW":   "workflow_name",
-			"GITHUB_HEAD_REF":   "pr_branch",
-			"GITHUB_ACTOR":      "pr_user",
-			"GITHUB_REPOSITORY": "repo",
-		}
+// arbitraryFields adds the fields provided by the end user. Later sources
+// override earlier ones: first the file at loc, then each of the extra field
+// files in order, then the fields given on the command line. In typed mode
+// values are only turned in to numbers or booleans when that doesn't change
+// them, and a schema may declare what each field's type is.
+func arbitraryFields(ecfg *eventConfig, loc string, ev *libhoney.Event) {
+	typed := ecfg.typedFields || ecfg.fieldSchema != ""
+	schema, err := loadFieldSchema(ecfg.fieldSchema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load field schema: %v\n", err)
+	}
 
-	case "bitbucket-pipelines", "bitbucketpipelines", "bitbucket":
-		envVars = map[string]string{
-			"BITBUCKET_BRANCH":              "branch",
-			"BITBUCKET_PIPELINE_UUID":       "pipeline_id",
-			"BITBUCKET_BUILD_NUMBER":        "build_num",
-			"BITBUCKET_REPO_FULL_NAME":      "repo",
-			"BITBUCKET_PR_ID":               "pr_id",
-			"BITBUCKET_STEP_TRIGGERER_UUID": "build_user",
+	for _, ff := range append([]string{loc}, ecfg.fieldFiles...) {
+		fields := fieldFile(ff, ecfg.fileFormat, typed)
+		for _, err := range schema.apply(fields) {
+			fmt.Fprintf(os.Stderr, "problems loading from %q: %v\n", ff, err)
 		}
+		ev.Add(fields)
 	}
-	for envVar, fieldName := range envVars {
-		if val, ok := os.LookupEnv(envVar); ok {
-			ev.AddField(fieldName, val)
+	for _, field := range ecfg.fields {
+		key, val, err := parseField(field, typed, schema)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid field: %v\n", err)
+			continue
 		}
+		ev.AddField(key, val)
 	}
 }
 
-// arbitraryFields adds an arbitrary set of fields provided by the end user
-func arbitraryFields(loc string, ev *libhoney.Event) {
+// fieldFile reads the fields from a file. The file's format is given or
+// chosen by its extension.
+func fieldFile(loc string, format string, typed bool) map[string]interface{} {
 	if loc == "" {
-		return
+		return nil
+	}
+
+	format, err := fieldFileFormat(loc, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil
 	}
 
 	data, err := ioutil.ReadFile(loc)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "unable to read %q: %v\n", loc, err)
-		return
+		return nil
 	}
 
-	err = logfmt.Unmarshal(
-		data,
-		logfmt.HandlerFunc(func(key, val []byte) error {
-			if f, err := strconv.ParseFloat(string(val), 64); err == nil {
-				ev.AddField(string(key), f)
-				return nil
-			}
-			if b, err := strconv.ParseBool(string(val)); err == nil {
-				ev.AddField(string(key), b)
-				return nil
-			}
-			ev.AddField(string(key), string(val))
-			return nil
-		}),
-	)
+	// return what we could parse, even if there were problems
+	fields, err := parseFieldFile(data, format, typed)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "problems loading from %q: %v\n", loc, err)
 	}
+	return fields
 }
 
 // parseUnix reads the input text as a Unix timestamp (to the second)
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// diffConfig holds the options for describing the changes being built
+type diffConfig struct {
+	// base is the ref to compare HEAD against. No diff fields are added if
+	// it's empty.
+	base string
+	// components are glob=name pairs naming the parts of the repository
+	components []string
+}
+
+// addDiffFlags adds the flags for diffConfig to a command
+func addDiffFlags(cmd *cobra.Command, dcfg *diffConfig) {
+	cmd.Flags().StringVar(&dcfg.base, "diff-base", "", "[env.BUILDEVENT_DIFF_BASE] git ref (such as origin/main) to compare HEAD against, adding diff.* fields counting the files and lines changed since HEAD branched from it")
+	if base, ok := os.LookupEnv("BUILDEVENT_DIFF_BASE"); ok {
+		cmd.Flags().Lookup("diff-base").Value.Set(base)
+	}
+
+	cmd.Flags().StringSliceVar(&dcfg.components, "component", nil, "[env.BUILDEVENT_COMPONENTS] glob=name pairs, such as 'services/api=api', naming the parts of the repository the diff.components field lists; a glob matching a directory matches everything in it")
+	if comps, ok := os.LookupEnv("BUILDEVENT_COMPONENTS"); ok {
+		cmd.Flags().Lookup("component").Value.Set(comps)
+	}
+}
+
+// diffFile is one changed file
+type diffFile struct {
+	path    string
+	added   int
+	removed int
+}
+
+// diffInfo adds fields describing the changes between the diff base and HEAD
+// in the current directory. Problems running git are reported but don't stop
+// the span being sent.
+func diffInfo(dcfg *diffConfig, ev *libhoney.Event) {
+	if dcfg.base == "" {
+		return
+	}
+	components, err := parseComponents(dcfg.components)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid component: %v\n", err)
+		return
+	}
+	// three dots compares against the merge base, so changes made on the base
+	// since we branched don't count
+	out, err := exec.Command("git", "-c", "core.quotepath=off", "diff", "--numstat", "--no-renames", dcfg.base+"...HEAD").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		fmt.Fprintf(os.Stderr, "unable to diff against %q: %v\n", dcfg.base, err)
+		return
+	}
+	ev.AddField("diff.base", dcfg.base)
+	ev.Add(diffFields(parseNumstat(string(out)), components))
+}
+
+// component names the files matching a glob
+type component struct {
+	glob string
+	name string
+}
+
+// parseComponents parses glob=name pairs
+func parseComponents(specs []string) ([]component, error) {
+	var components []component
+	for _, spec := range specs {
+		glob, name, ok := strings.Cut(spec, "=")
+		glob, name = strings.TrimSpace(glob), strings.TrimSpace(name)
+		if !ok || glob == "" || name == "" {
+			return nil, fmt.Errorf("%q is not of the form glob=name", spec)
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", spec, err)
+		}
+		components = append(components, component{glob: strings.TrimSuffix(glob, "/"), name: name})
+	}
+	return components, nil
+}
+
+// matches returns true if the glob matches the file or any of the directories
+// it's in
+func (c component) matches(file string) bool {
+	for p := file; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(c.glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNumstat parses the output of git diff --numstat. Binary files are
+// listed with no lines added or removed.
+func parseNumstat(out string) []diffFile {
+	var files []diffFile
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		// binary files have "-" in place of the counts
+		added, _ := strconv.Atoi(parts[0])
+		removed, _ := strconv.Atoi(parts[1])
+		files = append(files, diffFile{path: parts[2], added: added, removed: removed})
+	}
+	return files
+}
+
+// diffFields summarises the changed files. Files in the root of the
+// repository count as being in the "." directory.
+func diffFields(files []diffFile, components []component) map[string]interface{} {
+	var added, removed int
+	dirs := map[string]bool{}
+	names := map[string]bool{}
+	for _, f := range files {
+		added += f.added
+		removed += f.removed
+		dir, _, ok := strings.Cut(f.path, "/")
+		if !ok {
+			dir = "."
+		}
+		dirs[dir] = true
+		for _, c := range components {
+			if c.matches(f.path) {
+				names[c.name] = true
+			}
+		}
+	}
+
+	fields := map[string]interface{}{
+		"diff.files_changed": len(files),
+		"diff.lines_added":   added,
+		"diff.lines_removed": removed,
+		"diff.dirs":          joinKeys(dirs),
+		"diff.dir_count":     len(dirs),
+	}
+	if len(components) > 0 {
+		fields["diff.components"] = joinKeys(names)
+		fields["diff.component_count"] = len(names)
+	}
+	return fields
+}
+
+// joinKeys returns the keys of the set, sorted and separated by commas
+func joinKeys(set map[string]bool) string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
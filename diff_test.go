@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNumstat(t *testing.T) {
+	out := "3\t1\tservices/api/main.go\n-\t-\tdocs/logo.png\n10\t0\tREADME.md\n"
+	assert.Equal(t, []diffFile{
+		{path: "services/api/main.go", added: 3, removed: 1},
+		{path: "docs/logo.png"},
+		{path: "README.md", added: 10},
+	}, parseNumstat(out))
+	assert.Empty(t, parseNumstat(""))
+}
+
+func TestParseComponents(t *testing.T) {
+	components, err := parseComponents([]string{"services/api/=api", " web/* = frontend "})
+	require.NoError(t, err)
+	assert.Equal(t, []component{{"services/api", "api"}, {"web/*", "frontend"}}, components)
+
+	for _, bad := range []string{"services/api", "=api", "services/api=", "[=x"} {
+		_, err := parseComponents([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	files := []diffFile{
+		{path: "services/api/main.go", added: 3, removed: 1},
+		{path: "services/api/handlers/users.go", added: 5, removed: 5},
+		{path: "web/app/index.ts", added: 1},
+		{path: "docs/logo.png"},
+		{path: "README.md", added: 10},
+	}
+	components := []component{
+		{"services/api", "api"},
+		{"services/worker", "worker"},
+		{"web/*", "frontend"},
+		{"*.md", "docs"},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"diff.files_changed":   5,
+		"diff.lines_added":     19,
+		"diff.lines_removed":   6,
+		"diff.dirs":            ".,docs,services,web",
+		"diff.dir_count":       4,
+		"diff.components":      "api,docs,frontend",
+		"diff.component_count": 3,
+	}, diffFields(files, components))
+
+	// without components, there are no component fields
+	fields := diffFields(nil, nil)
+	assert.Equal(t, 0, fields["diff.files_changed"])
+	assert.Equal(t, "", fields["diff.dirs"])
+	assert.NotContains(t, fields, "diff.components")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+)
+
+// defaultEnvDeny are patterns for the names of environment variables that are
+// likely to hold secrets, which are never turned in to fields.
+var defaultEnvDeny = []string{
+	"*TOKEN*",
+	"*SECRET*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*KEY*",
+	"*CREDENTIAL*",
+	"*PRIVATE*",
+	// not *AUTH*, which would catch the many *_AUTHOR variables
+	"*AUTH",
+	"*AUTH_*",
+	"*COOKIE*",
+	"*SESSION*",
+}
+
+// envFields turns the environment variables selected by the event config in
+// to fields. Variables starting with one of the prefixes are named by what
+// follows the prefix, and allowed variables by their whole name, both
+// lowercased. Variables matching a deny pattern are always skipped. environ
+// is in the form returned by os.Environ.
+func envFields(ecfg *eventConfig, environ []string) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if len(ecfg.envPrefixes) == 0 && len(ecfg.envAllow) == 0 {
+		return fields
+	}
+	deny := upperPatterns(envDenyPatterns(ecfg))
+
+	for _, kv := range environ {
+		name, val, ok := strings.Cut(kv, "=")
+		// on Windows, there are variables like "=C:" we don't want
+		if !ok || name == "" {
+			continue
+		}
+		field := envFieldName(name, ecfg.envPrefixes, ecfg.envAllow)
+		if field == "" || matchAny(deny, strings.ToUpper(name)) {
+			continue
+		}
+		fields[field] = val
+	}
+	return fields
+}
+
+// envDenyPatterns returns the default deny patterns plus any the user added
+func envDenyPatterns(ecfg *eventConfig) []string {
+	return append(append([]string(nil), defaultEnvDeny...), ecfg.envDeny...)
+}
+
+// envFieldName returns the name of the field for the environment variable, or
+// "" if it isn't selected.
+func envFieldName(name string, prefixes []string, allow []string) string {
+	upper := strings.ToUpper(name)
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(upper, strings.ToUpper(prefix)); ok && rest != "" {
+			return strings.ToLower(rest)
+		}
+	}
+	if matchAny(upperPatterns(allow), upper) {
+		return strings.ToLower(name)
+	}
+	return ""
+}
+
+// upperPatterns returns the glob patterns in upper case. Environment variable
+// names are matched ignoring case by matching them in upper case too.
+func upperPatterns(patterns []string) []string {
+	upper := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		upper[i] = strings.ToUpper(pattern)
+	}
+	return upper
+}
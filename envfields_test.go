@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvFields(t *testing.T) {
+	environ := []string{
+		"BUILD_META_TEAM=payments",
+		"BUILD_META_Owner=alice",
+		"BUILD_META_=nothing",
+		"BUILD_META_DEPLOY_TOKEN=hunter2",
+		"BUILD_META_AUTHOR=bob",
+		"BUILD_META_BASIC_AUTH=user:pass",
+		"BUILD_META_AUTH_HEADER=Bearer x",
+		"NODE_VERSION=20.11.0",
+		"GO_VERSION=1.22",
+		"AWS_SECRET_ACCESS_KEY=shh",
+		"DOCKER_PASSWORD=shh",
+		"HOME=/root",
+		"EQUALS=a=b",
+		"=C:=C:\\",
+	}
+
+	testCases := []struct {
+		desc   string
+		ecfg   eventConfig
+		expect map[string]interface{}
+	}{
+		{
+			desc:   "nothing selected",
+			ecfg:   eventConfig{},
+			expect: map[string]interface{}{},
+		},
+		{
+			desc: "prefix is stripped and lowercased",
+			ecfg: eventConfig{envPrefixes: []string{"BUILD_META_"}},
+			expect: map[string]interface{}{
+				"team":   "payments",
+				"owner":  "alice",
+				"author": "bob",
+			},
+		},
+		{
+			desc: "allow list keeps the whole name",
+			ecfg: eventConfig{envAllow: []string{"*_VERSION", "equals", "AWS_SECRET_ACCESS_KEY"}},
+			expect: map[string]interface{}{
+				"node_version": "20.11.0",
+				"go_version":   "1.22",
+				"equals":       "a=b",
+			},
+		},
+		{
+			desc: "extra deny patterns",
+			ecfg: eventConfig{envPrefixes: []string{"build_meta_"}, envDeny: []string{"*OWNER", "*AUTHOR"}},
+			expect: map[string]interface{}{
+				"team": "payments",
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.expect, envFields(&tC.ecfg, environ))
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kr/logfmt"
+	"gopkg.in/yaml.v3"
+)
+
+// The formats understood for the file of arbitrary fields
+const (
+	formatLogfmt = "logfmt"
+	formatJSON   = "json"
+	formatYAML   = "yaml"
+	formatDotenv = "dotenv"
+)
+
+// fieldFileFormat returns the format of the fields file. An explicit format
+// wins; otherwise it's chosen by the file's extension, defaulting to logfmt.
+func fieldFileFormat(loc string, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", "auto":
+	case formatLogfmt:
+		return formatLogfmt, nil
+	case formatJSON:
+		return formatJSON, nil
+	case formatYAML, "yml":
+		return formatYAML, nil
+	case formatDotenv, "env":
+		return formatDotenv, nil
+	default:
+		return "", fmt.Errorf("unknown fields file format %q", format)
+	}
+
+	switch strings.ToLower(filepath.Ext(loc)) {
+	case ".json":
+		return formatJSON, nil
+	case ".yaml", ".yml":
+		return formatYAML, nil
+	case ".env":
+		return formatDotenv, nil
+	}
+	return formatLogfmt, nil
+}
+
+// parseFieldFile parses the contents of a fields file in the given format. In
+// typed mode, quoted values in logfmt, dotenv and YAML files stay strings and
+// other values are only turned in to numbers or booleans if that doesn't change
+// them.
+func parseFieldFile(data []byte, format string, typed bool) (map[string]interface{}, error) {
+	switch format {
+	case formatJSON:
+		return parseJSONFields(data)
+	case formatYAML:
+		return parseYAMLFields(data, typed)
+	case formatDotenv:
+		return parseDotenvFields(data, typed)
+	}
+	if typed {
+		return parseTypedLogfmtFields(data)
+	}
+	return parseLogfmtFields(data)
+}
+
+// parseFieldLines reads fields written a line at a time, where each line is
+// either a JSON object or logfmt pairs. Later lines override earlier ones.
+func parseFieldLines(data []byte, typed bool) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	var errs []string
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		format := formatLogfmt
+		if line[0] == '{' {
+			format = formatJSON
+		}
+		lineFields, err := parseFieldFile(line, format, typed)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %v", i+1, err))
+		}
+		for k, v := range lineFields {
+			fields[k] = v
+		}
+	}
+	if len(errs) > 0 {
+		return fields, errors.New(strings.Join(errs, "; "))
+	}
+	return fields, nil
+}
+
+// parseLogfmtFields reads key=val pairs. logfmt has no types, so values that
+// look like numbers or booleans are turned in to them.
+func parseLogfmtFields(data []byte) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	err := logfmt.Unmarshal(
+		data,
+		logfmt.HandlerFunc(func(key, val []byte) error {
+			fields[string(key)] = guessType(string(val))
+			return nil
+		}),
+	)
+	return fields, err
+}
+
+// guessType turns values that look like numbers or booleans in to them
+func guessType(val string) interface{} {
+	if f, err := strconv.ParseFloat(val, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(val); err == nil {
+		return b
+	}
+	return val
+}
+
+// parseField parses a key=val field given on the command line. The key may
+// end with a type, as in key:int=val, which the value must have. Otherwise the
+// schema's type is used if it has one, or the type is inferred in typed mode
+// or guessed as it is for logfmt.
+func parseField(field string, typed bool, schema fieldSchema) (string, interface{}, error) {
+	key, val, ok := strings.Cut(field, "=")
+	if !ok || key == "" {
+		return "", nil, fmt.Errorf("%q is not of the form key=val", field)
+	}
+	untyped := func(key string) (string, interface{}, error) {
+		if typ := schema.typeOf(key); typ != "" {
+			v, err := coerceField(val, typ)
+			if err != nil {
+				return "", nil, fmt.Errorf("%q: %w", field, err)
+			}
+			return key, v, nil
+		}
+		if typed {
+			return key, inferType(val), nil
+		}
+		return key, guessType(val), nil
+	}
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return untyped(key)
+	}
+
+	name, typ := key[:i], key[i+1:]
+	var converted interface{}
+	var err error
+	switch typ {
+	case "int":
+		converted, err = strconv.ParseInt(val, 10, 64)
+	case "float":
+		converted, err = strconv.ParseFloat(val, 64)
+	case "bool":
+		converted, err = strconv.ParseBool(val)
+	case "str", "string":
+		converted = val
+	default:
+		// not a type, just a key with a colon in it
+		return untyped(key)
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("%q is not of the form key=val", field)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%q: value is not a %s", field, typ)
+	}
+	return name, converted, nil
+}
+
+// parseJSONFields reads a JSON object. Integers stay integers, and nested
+// objects are flattened to dotted keys. The object is read a member at a time,
+// so that the members before a problem are still returned.
+func parseJSONFields(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	fields := map[string]interface{}{}
+	if tok, err := dec.Token(); err != nil {
+		return fields, err
+	} else if tok != json.Delim('{') {
+		return fields, errors.New("expected a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fields, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fields, fmt.Errorf("expected a key, got %v", tok)
+		}
+		var val interface{}
+		if err := dec.Decode(&val); err != nil {
+			return fields, fmt.Errorf("%s: %w", key, err)
+		}
+		flattenFields("", map[string]interface{}{key: val}, fields)
+	}
+	if _, err := dec.Token(); err != nil {
+		return fields, err
+	}
+	return fields, nil
+}
+
+// parseYAMLFields reads a YAML map, flattening nested maps to dotted keys. In
+// typed mode, unquoted numbers and booleans are only converted if that
+// doesn't change them.
+func parseYAMLFields(data []byte, typed bool) (map[string]interface{}, error) {
+	if typed {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		fields := map[string]interface{}{}
+		err := flattenYAMLNode("", &doc, fields)
+		return fields, err
+	}
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	flattenFields("", obj, fields)
+	return fields, nil
+}
+
+// flattenFields copies obj in to fields, turning nested objects in to dotted
+// keys like "outer.inner". Other values, including lists, are kept as they are.
+func flattenFields(prefix string, obj map[string]interface{}, fields map[string]interface{}) {
+	for k, v := range obj {
+		key := prefix + k
+		switch val := v.(type) {
+		case map[string]interface{}:
+			flattenFields(key+".", val, fields)
+		case json.Number:
+			if i, err := val.Int64(); err == nil {
+				fields[key] = i
+			} else if f, err := val.Float64(); err == nil {
+				fields[key] = f
+			} else {
+				fields[key] = val.String()
+			}
+		default:
+			fields[key] = val
+		}
+	}
+}
+
+// parseDotenvFields reads KEY=value lines as written for shells and docker
+// --env-file. Lines may start with "export", comments start with #, and values
+// may be quoted. Every value is a string, unless in typed mode, when unquoted
+// values may be numbers or booleans. The fields before a bad line are
+// returned along with the error.
+func parseDotenvFields(data []byte, typed bool) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, val, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fields, fmt.Errorf("line %d: expected KEY=value", lineNum)
+		}
+		val = strings.TrimSpace(val)
+
+		switch {
+		case len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"':
+			unquoted, err := strconv.Unquote(val)
+			if err != nil {
+				return fields, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			fields[key] = unquoted
+		case len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'':
+			// single quotes are literal
+			fields[key] = val[1 : len(val)-1]
+		default:
+			// an unquoted value may be followed by a comment
+			if i := strings.Index(val, " #"); i >= 0 {
+				val = strings.TrimSpace(val[:i])
+			}
+			if typed {
+				fields[key] = inferType(val)
+			} else {
+				fields[key] = val
+			}
+		}
+	}
+	return fields, scanner.Err()
+}
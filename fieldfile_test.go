@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+func TestFieldFileFormat(t *testing.T) {
+	testCases := []struct {
+		loc    string
+		format string
+		expect string
+	}{
+		{"fields.txt", "", formatLogfmt},
+		{"fields", "", formatLogfmt},
+		{"fields.json", "", formatJSON},
+		{"fields.JSON", "auto", formatJSON},
+		{"fields.yml", "", formatYAML},
+		{"fields.yaml", "", formatYAML},
+		{".env", "", formatDotenv},
+		{"build.env", "", formatDotenv},
+		{"fields.json", "logfmt", formatLogfmt},
+		{"fields.txt", "YAML", formatYAML},
+	}
+	for _, tC := range testCases {
+		format, err := fieldFileFormat(tC.loc, tC.format)
+		require.NoError(t, err)
+		assert.Equal(t, tC.expect, format, tC.loc)
+	}
+
+	_, err := fieldFileFormat("fields.txt", "toml")
+	assert.Error(t, err)
+}
+
+func TestParseFieldFile(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		format string
+		data   string
+		expect map[string]interface{}
+	}{
+		{
+			desc:   "logfmt guesses types",
+			format: formatLogfmt,
+			data:   "count=3 ok=true\nname=\"go test\"",
+			expect: map[string]interface{}{"count": 3.0, "ok": true, "name": "go test"},
+		},
+		{
+			desc:   "json keeps types and flattens objects",
+			format: formatJSON,
+			data:   `{"count": 3, "ratio": 0.5, "ok": true, "version": "1.10", "tests": {"passed": 10, "go": {"version": "1.22"}}, "tags": ["a", "b"], "none": null}`,
+			expect: map[string]interface{}{
+				"count":            int64(3),
+				"ratio":            0.5,
+				"ok":               true,
+				"version":          "1.10",
+				"tests.passed":     int64(10),
+				"tests.go.version": "1.22",
+				"tags":             []interface{}{"a", "b"},
+				"none":             nil,
+			},
+		},
+		{
+			desc:   "yaml keeps types and flattens maps",
+			format: formatYAML,
+			data:   "count: 3\nratio: 0.5\nok: true\nversion: \"1.10\"\ntests:\n  passed: 10\n",
+			expect: map[string]interface{}{
+				"count":        3,
+				"ratio":        0.5,
+				"ok":           true,
+				"version":      "1.10",
+				"tests.passed": 10,
+			},
+		},
+		{
+			desc:   "dotenv values are strings",
+			format: formatDotenv,
+			data:   "# comment\nCOUNT=3\nexport NAME=\"go test\\nall\"\nLITERAL='a\\nb'\nPLAIN=value # trailing\n\nEMPTY=\n",
+			expect: map[string]interface{}{
+				"COUNT":   "3",
+				"NAME":    "go test\nall",
+				"LITERAL": `a\nb`,
+				"PLAIN":   "value",
+				"EMPTY":   "",
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			fields, err := parseFieldFile([]byte(tC.data), tC.format, false)
+			require.NoError(t, err)
+			assert.Equal(t, tC.expect, fields)
+		})
+	}
+}
+
+func TestParseFieldFileErrors(t *testing.T) {
+	for format, data := range map[string]string{
+		formatJSON:   `["not", "an", "object"]`,
+		formatYAML:   "- not\n- a map\n",
+		formatDotenv: "NOT A PAIR\n",
+	} {
+		_, err := parseFieldFile([]byte(data), format, false)
+		assert.Error(t, err, format)
+	}
+}
+
+func TestParseFieldFilePartial(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		format string
+		data   string
+	}{
+		{"json", formatJSON, `{"before": 1, "nested": {"ok": true}, "after": }`},
+		{"dotenv", formatDotenv, "BEFORE=1\nNESTED_OK=true\nNOT A PAIR\nAFTER=2\n"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			fields, err := parseFieldFile([]byte(tC.data), tC.format, false)
+			assert.Error(t, err)
+			assert.Len(t, fields, 2)
+			assert.NotContains(t, fields, "after")
+			assert.NotContains(t, fields, "AFTER")
+		})
+	}
+}
+
+func TestParseField(t *testing.T) {
+	testCases := []struct {
+		field  string
+		key    string
+		expect interface{}
+	}{
+		{"count=3", "count", 3.0},
+		{"ok=true", "ok", true},
+		{"name=go test", "name", "go test"},
+		{"count:int=3", "count", int64(3)},
+		{"ratio:float=0.5", "ratio", 0.5},
+		{"ok:bool=false", "ok", false},
+		{"agent:str=007", "agent", "007"},
+		{"empty=", "empty", ""},
+		{"url=http://example.com?a=b", "url", "http://example.com?a=b"},
+		{"http:status=200", "http:status", 200.0},
+	}
+	for _, tC := range testCases {
+		key, val, err := parseField(tC.field, false, nil)
+		require.NoError(t, err, tC.field)
+		assert.Equal(t, tC.key, key, tC.field)
+		assert.Equal(t, tC.expect, val, tC.field)
+	}
+
+	for _, bad := range []string{"novalue", "=3", ":int=3", "count:int=three", "ok:bool=maybe"} {
+		_, _, err := parseField(bad, false, nil)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestArbitraryFieldsPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	mainFile := filepath.Join(dir, "fields.txt")
+	extra := filepath.Join(dir, "extra.json")
+	require.NoError(t, os.WriteFile(mainFile, []byte("a=main b=main c=main"), 0644))
+	require.NoError(t, os.WriteFile(extra, []byte(`{"b": "extra", "c": "extra"}`), 0644))
+
+	ev := libhoney.NewEvent()
+	ecfg := &eventConfig{
+		fieldFiles: []string{extra},
+		fields:     []string{"c=flag"},
+	}
+	arbitraryFields(ecfg, mainFile, ev)
+	fields := ev.Fields()
+	assert.Equal(t, "main", fields["a"])
+	assert.Equal(t, "extra", fields["b"])
+	assert.Equal(t, "flag", fields["c"])
+}
+
+func TestParseFieldLines(t *testing.T) {
+	data := "tests=10 result=pass\n\n{\"coverage\": {\"percent\": 81.5}, \"tests\": 12}\nbroken=\"unterminated\n"
+	fields, err := parseFieldLines([]byte(data), true)
+	assert.ErrorContains(t, err, "line 4")
+	assert.Equal(t, map[string]interface{}{
+		"tests":            int64(12),
+		"result":           "pass",
+		"coverage.percent": 81.5,
+	}, fields)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kr/logfmt"
+	"gopkg.in/yaml.v3"
+)
+
+// The types a field schema may declare
+const (
+	fieldTypeString = "string"
+	fieldTypeInt    = "int"
+	fieldTypeFloat  = "float"
+	fieldTypeBool   = "bool"
+)
+
+// canonicalInt matches integers written the way strconv.FormatInt would write
+// them, so that zip codes like 02134 aren't treated as numbers.
+var canonicalInt = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+
+// inferType turns a value in to a number or boolean only if it would be
+// written back out exactly the same, so that values like 1.10, 02134 and 1e5
+// stay strings.
+func inferType(val string) interface{} {
+	switch val {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if canonicalInt.MatchString(val) {
+		if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return i
+		}
+		return val
+	}
+	if f, err := strconv.ParseFloat(val, 64); err == nil && strconv.FormatFloat(f, 'f', -1, 64) == val {
+		return f
+	}
+	return val
+}
+
+// logfmtPair is a key=val pair from a logfmt file
+type logfmtPair struct {
+	key    string
+	val    string
+	quoted bool
+}
+
+// scanLogfmt splits logfmt data in to its key=val pairs, remembering which
+// values were quoted. A key on its own has an empty value.
+func scanLogfmt(data []byte) ([]logfmtPair, error) {
+	var pairs []logfmtPair
+	s := string(data)
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+	for i := 0; i < len(s); {
+		if isSpace(s[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(s) && !isSpace(s[i]) && s[i] != '=' && s[i] != '"' {
+			i++
+		}
+		if i == start {
+			return pairs, fmt.Errorf("unexpected %q at offset %d", s[i], i)
+		}
+		pair := logfmtPair{key: s[start:i]}
+		if i >= len(s) || s[i] != '=' {
+			pairs = append(pairs, pair)
+			continue
+		}
+		i++ // skip the =
+
+		if i < len(s) && s[i] == '"' {
+			// find the closing quote, skipping escaped characters
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return pairs, fmt.Errorf("unterminated quoted value for %q", pair.key)
+			}
+			val, err := unquoteLogfmt(s[i : end+1])
+			if err != nil {
+				return pairs, fmt.Errorf("invalid quoted value for %q: %v", pair.key, err)
+			}
+			pair.val, pair.quoted = val, true
+			i = end + 1
+		} else {
+			start = i
+			for i < len(s) && !isSpace(s[i]) {
+				i++
+			}
+			pair.val = s[start:i]
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// unquoteLogfmt unquotes a quoted value the same way the logfmt decoder does,
+// so quoted values may span lines in typed mode too
+func unquoteLogfmt(quoted string) (string, error) {
+	var val string
+	err := logfmt.Unmarshal(
+		[]byte("v="+quoted),
+		logfmt.HandlerFunc(func(key, v []byte) error {
+			val = string(v)
+			return nil
+		}),
+	)
+	return val, err
+}
+
+// parseTypedLogfmtFields reads key=val pairs, keeping quoted values as strings
+// and inferring the types of the others.
+func parseTypedLogfmtFields(data []byte) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	pairs, err := scanLogfmt(data)
+	for _, p := range pairs {
+		if p.quoted {
+			fields[p.key] = p.val
+		} else {
+			fields[p.key] = inferType(p.val)
+		}
+	}
+	return fields, err
+}
+
+// flattenYAMLNode adds the fields of a YAML map in typed mode, turning nested
+// maps in to dotted keys. Unquoted numbers and booleans are read from the text
+// as it was written, so that 1.10 isn't turned in to 1.1 before a schema
+// declares it a string.
+func flattenYAMLNode(prefix string, node *yaml.Node, fields map[string]interface{}) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return flattenYAMLNode(prefix, node.Content[0], fields)
+	case yaml.AliasNode:
+		return flattenYAMLNode(prefix, node.Alias, fields)
+	case yaml.MappingNode:
+	default:
+		return fmt.Errorf("line %d: expected a map", node.Line)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := prefix + node.Content[i].Value
+		val := node.Content[i+1]
+		if val.Kind == yaml.AliasNode {
+			val = val.Alias
+		}
+		if val.Kind == yaml.MappingNode {
+			if err := flattenYAMLNode(key+".", val, fields); err != nil {
+				return err
+			}
+			continue
+		}
+		if val.Kind == yaml.ScalarNode && val.Style == 0 {
+			switch val.ShortTag() {
+			case "!!int", "!!float", "!!bool":
+				fields[key] = inferType(val.Value)
+				continue
+			}
+		}
+		var v interface{}
+		if err := val.Decode(&v); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		fields[key] = v
+	}
+	return nil
+}
+
+// fieldSchema maps field names, or glob patterns matching them, to the type
+// each field must have
+type fieldSchema map[string]string
+
+// loadFieldSchema reads a schema from a YAML or JSON file. An empty location
+// gives an empty schema.
+func loadFieldSchema(loc string) (fieldSchema, error) {
+	if loc == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		return nil, err
+	}
+	var schema fieldSchema
+	if err := yaml.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("problems loading from %q: %w", loc, err)
+	}
+	for field, typ := range schema {
+		switch typ {
+		case fieldTypeString, fieldTypeInt, fieldTypeFloat, fieldTypeBool:
+		case "str":
+			schema[field] = fieldTypeString
+		default:
+			return nil, fmt.Errorf("field %q has unknown type %q", field, typ)
+		}
+	}
+	return schema, nil
+}
+
+// typeOf returns the declared type of the field, or "" if it has none. An
+// exact match wins over a pattern, and patterns are tried in sorted order.
+func (s fieldSchema) typeOf(field string) string {
+	if typ, ok := s[field]; ok {
+		return typ
+	}
+	patterns := make([]string, 0, len(s))
+	for p := range s {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, field); ok {
+			return s[p]
+		}
+	}
+	return ""
+}
+
+// apply converts the fields to their declared types in place. Fields that
+// can't be converted are left as they are, and the problems returned.
+func (s fieldSchema) apply(fields map[string]interface{}) []error {
+	if len(s) == 0 {
+		return nil
+	}
+	var errs []error
+	for field, val := range fields {
+		typ := s.typeOf(field)
+		if typ == "" {
+			continue
+		}
+		converted, err := coerceField(val, typ)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("field %q: %w", field, err))
+			continue
+		}
+		fields[field] = converted
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+// coerceField converts a value to the given type
+func coerceField(val interface{}, typ string) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	if typ == fieldTypeString {
+		if s, ok := val.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(val), nil
+	}
+
+	// everything else is parsed from its string form, which is exact for
+	// the strings and numbers we get from field files
+	var str string
+	switch v := val.(type) {
+	case string:
+		str = strings.TrimSpace(v)
+	case float64:
+		if typ == fieldTypeInt && v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v), nil
+		}
+		str = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		str = fmt.Sprint(v)
+	}
+
+	var converted interface{}
+	var err error
+	switch typ {
+	case fieldTypeInt:
+		converted, err = strconv.ParseInt(str, 10, 64)
+	case fieldTypeFloat:
+		converted, err = strconv.ParseFloat(str, 64)
+	case fieldTypeBool:
+		converted, err = strconv.ParseBool(str)
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a %s", str, typ)
+	}
+	return converted, nil
+}
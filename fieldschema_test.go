@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+func TestInferType(t *testing.T) {
+	testCases := []struct {
+		val    string
+		expect interface{}
+	}{
+		{"3", int64(3)},
+		{"-42", int64(-42)},
+		{"0", int64(0)},
+		{"0.5", 0.5},
+		{"-2.25", -2.25},
+		{"true", true},
+		{"false", false},
+		{"1.10", "1.10"},
+		{"02134", "02134"},
+		{"1e5", "1e5"},
+		{"+3", "+3"},
+		{"99999999999999999999", "99999999999999999999"},
+		{"TRUE", "TRUE"},
+		{"t", "t"},
+		{"", ""},
+		{"abc", "abc"},
+	}
+	for _, tC := range testCases {
+		assert.Equal(t, tC.expect, inferType(tC.val), tC.val)
+	}
+}
+
+func TestScanLogfmt(t *testing.T) {
+	pairs, err := scanLogfmt([]byte("version=\"1.10\" zip=02134\nsha=1e5 msg=\"say \\\"hi\\\"\" flag count=3\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []logfmtPair{
+		{key: "version", val: "1.10", quoted: true},
+		{key: "zip", val: "02134"},
+		{key: "sha", val: "1e5"},
+		{key: "msg", val: `say "hi"`, quoted: true},
+		{key: "flag"},
+		{key: "count", val: "3"},
+	}, pairs)
+
+	pairs, err = scanLogfmt([]byte("notes=\"first\nsecond\""))
+	require.NoError(t, err)
+	assert.Equal(t, []logfmtPair{{key: "notes", val: "first\nsecond", quoted: true}}, pairs)
+
+	for _, bad := range []string{`a="unterminated`, `"quoted"=key`, `=value`} {
+		_, err := scanLogfmt([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseTypedFields(t *testing.T) {
+	fields, err := parseFieldFile([]byte(`version="1.10" minor=1.10 count=3 ok=true quoted="3"`), formatLogfmt, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"version": "1.10",
+		"minor":   "1.10",
+		"count":   int64(3),
+		"ok":      true,
+		"quoted":  "3",
+	}, fields)
+
+	fields, err = parseFieldFile([]byte("COUNT=3\nQUOTED=\"3\"\nZIP=02134\n"), formatDotenv, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"COUNT": int64(3), "QUOTED": "3", "ZIP": "02134"}, fields)
+
+	// quoted values may span lines
+	fields, err = parseFieldFile([]byte("notes=\"first\nsecond\" count=3"), formatLogfmt, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"notes": "first\nsecond", "count": int64(3)}, fields)
+
+	yamlData := "version: 1.10\nquoted: \"3\"\ncount: 3\nok: true\nloud: TRUE\nbuild:\n  number: 12\n  ratio: 0.5\ntags: [a, b]\n"
+	fields, err = parseFieldFile([]byte(yamlData), formatYAML, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"version":      "1.10",
+		"quoted":       "3",
+		"count":        int64(3),
+		"ok":           true,
+		"loud":         "TRUE",
+		"build.number": int64(12),
+		"build.ratio":  0.5,
+		"tags":         []interface{}{"a", "b"},
+	}, fields)
+}
+
+func TestFieldSchema(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "schema.yaml")
+	require.NoError(t, os.WriteFile(loc, []byte("version: string\nretries: int\nratio: float\ncached: bool\n\"tests.*\": int\nsha: str\n"), 0644))
+	schema, err := loadFieldSchema(loc)
+	require.NoError(t, err)
+	assert.Equal(t, "string", schema.typeOf("sha"))
+	assert.Equal(t, "int", schema.typeOf("tests.passed"))
+	assert.Equal(t, "", schema.typeOf("other"))
+
+	fields := map[string]interface{}{
+		"version":      1.1,
+		"retries":      "3",
+		"ratio":        int64(1),
+		"cached":       "true",
+		"tests.passed": 10.0,
+		"tests.failed": "none",
+		"other":        1.5,
+	}
+	errs := schema.apply(fields)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, map[string]interface{}{
+		"version":      "1.1",
+		"retries":      int64(3),
+		"ratio":        1.0,
+		"cached":       true,
+		"tests.passed": int64(10),
+		"tests.failed": "none",
+		"other":        1.5,
+	}, fields)
+
+	require.NoError(t, os.WriteFile(loc, []byte("version: semver\n"), 0644))
+	_, err = loadFieldSchema(loc)
+	assert.Error(t, err)
+}
+
+func TestArbitraryFieldsTyped(t *testing.T) {
+	dir := t.TempDir()
+	fieldsLoc := filepath.Join(dir, "fields.txt")
+	schemaLoc := filepath.Join(dir, "schema.json")
+	require.NoError(t, os.WriteFile(fieldsLoc, []byte(`version=1.10 zip=02134 build=12 sha=1e5`), 0644))
+	require.NoError(t, os.WriteFile(schemaLoc, []byte(`{"build": "string", "attempt": "int"}`), 0644))
+
+	ev := libhoney.NewEvent()
+	arbitraryFields(&eventConfig{
+		fieldSchema: schemaLoc,
+		fields:      []string{"attempt=2", "agent=007", "forced:float=3"},
+	}, fieldsLoc, ev)
+	assert.Equal(t, map[string]interface{}{
+		"version": "1.10",
+		"zip":     "02134",
+		"build":   "12",
+		"sha":     "1e5",
+		"attempt": int64(2),
+		"agent":   "007",
+		"forced":  3.0,
+	}, ev.Fields())
+}
+
+func TestArbitraryFieldsYAMLSchema(t *testing.T) {
+	dir := t.TempDir()
+	fieldsLoc := filepath.Join(dir, "fields.yaml")
+	schemaLoc := filepath.Join(dir, "schema.yaml")
+	require.NoError(t, os.WriteFile(fieldsLoc, []byte("version: 1.10\nratio: 1.10\nbuild: 12\n"), 0644))
+	require.NoError(t, os.WriteFile(schemaLoc, []byte("version: string\nratio: float\n"), 0644))
+
+	ev := libhoney.NewEvent()
+	arbitraryFields(&eventConfig{fieldSchema: schemaLoc}, fieldsLoc, ev)
+	assert.Equal(t, map[string]interface{}{
+		"version": "1.10",
+		"ratio":   1.1,
+		"build":   int64(12),
+	}, ev.Fields())
+}
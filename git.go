@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/heap"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitInfo gathers metadata about the git repository containing dir and the
+// commit checked out in it. It uses the git executable when there is one, and
+// otherwise reads the .git directory itself, which works in minimal
+// containers. Fields that can't be determined are left out.
+func gitInfo(dir string) map[string]interface{} {
+	if _, err := exec.LookPath("git"); err == nil {
+		if fields, err := gitInfoExec(dir); err == nil {
+			return fields
+		}
+	}
+	fields, err := gitInfoFiles(dir)
+	if err != nil {
+		return nil
+	}
+	return fields
+}
+
+// gitTimeout bounds how long we'll wait for git altogether, so that one stuck
+// waiting on a lock or a credential helper can't hold up the build
+var gitTimeout = 5 * time.Second
+
+// gitInfoExec gathers repository metadata by running git
+func gitInfoExec(dir string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	run := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		// don't let git status take the index lock from a build that's
+		// running at the same time
+		cmd.Env = append(os.Environ(), "GIT_OPTIONAL_LOCKS=0")
+		// and don't wait for anything git started that outlives it
+		cmd.WaitDelay = time.Second
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	sha, err := run("rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{"git.commit": sha}
+
+	if branch, err := run("symbolic-ref", "--quiet", "--short", "HEAD"); err == nil && branch != "" {
+		fields["git.branch"] = branch
+	}
+	if out, err := run("log", "-1", "--format=%an%x00%ae%x00%cI%x00%s"); err == nil {
+		if parts := strings.SplitN(out, "\x00", 4); len(parts) == 4 {
+			fields["git.author"] = parts[0]
+			fields["git.author_email"] = parts[1]
+			fields["git.commit_time"] = parts[2]
+			fields["git.subject"] = parts[3]
+		}
+	}
+	if out, err := run("tag", "--points-at", "HEAD"); err == nil && out != "" {
+		fields["git.tags"] = strings.Join(strings.Fields(out), ",")
+	}
+	if out, err := run("status", "--porcelain", "--untracked-files=no"); err == nil {
+		fields["git.dirty"] = out != ""
+	}
+
+	// find the default branch from the remote's HEAD, falling back to the
+	// usual names
+	defaultBranch := ""
+	if ref, err := run("symbolic-ref", "--quiet", "--short", "refs/remotes/origin/HEAD"); err == nil && ref != "" {
+		defaultBranch = ref
+	} else {
+		for _, candidate := range []string{"origin/main", "origin/master", "main", "master"} {
+			if _, err := run("rev-parse", "--verify", "--quiet", candidate); err == nil {
+				defaultBranch = candidate
+				break
+			}
+		}
+	}
+	if defaultBranch != "" {
+		fields["git.default_branch"] = strings.TrimPrefix(defaultBranch, "origin/")
+		// this fails in shallow clones, in which case we leave it out
+		if base, err := run("merge-base", "HEAD", defaultBranch); err == nil && base != "" {
+			fields["git.merge_base"] = base
+		}
+	}
+	return fields, nil
+}
+
+// gitInfoFiles gathers what repository metadata it can by reading the .git
+// directory directly.
+func gitInfoFiles(dir string) (map[string]interface{}, error) {
+	gitDir, workTree, err := findGitDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	sha := strings.TrimSpace(string(head))
+	if ref, ok := strings.CutPrefix(sha, "ref: "); ok {
+		fields["git.branch"] = strings.TrimPrefix(ref, "refs/heads/")
+		if sha, err = resolveRef(gitDir, ref); err != nil {
+			// a new repository with no commits yet
+			return nil, err
+		}
+	}
+	fields["git.commit"] = sha
+
+	if commit, err := readObject(gitDir, sha); err == nil {
+		for k, v := range parseCommit(commit) {
+			fields[k] = v
+		}
+	}
+
+	if tags := tagsAt(gitDir, sha); len(tags) > 0 {
+		fields["git.tags"] = strings.Join(tags, ",")
+	}
+	if dirty, err := workTreeDirty(gitDir, workTree); err == nil {
+		fields["git.dirty"] = dirty
+	}
+
+	if name, ref := defaultBranchRef(gitDir); ref != "" {
+		fields["git.default_branch"] = name
+		if target, err := resolveRef(gitDir, ref); err == nil {
+			// in shallow clones the history may not reach the merge base, in
+			// which case we leave it out
+			if base := mergeBase(gitDir, sha, target); base != "" {
+				fields["git.merge_base"] = base
+			}
+		}
+	}
+	return fields, nil
+}
+
+// defaultBranchRef finds the default branch from the remote's HEAD, falling
+// back to the usual names. It returns the branch's name and the ref to
+// resolve, or empty strings if there isn't one.
+func defaultBranchRef(gitDir string) (string, string) {
+	if data, err := os.ReadFile(filepath.Join(commonDir(gitDir), "refs", "remotes", "origin", "HEAD")); err == nil {
+		if ref, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "ref: "); ok {
+			return strings.TrimPrefix(ref, "refs/remotes/origin/"), ref
+		}
+	}
+	for _, ref := range []string{"refs/remotes/origin/main", "refs/remotes/origin/master", "refs/heads/main", "refs/heads/master"} {
+		if _, err := resolveRef(gitDir, ref); err == nil {
+			return path.Base(ref), ref
+		}
+	}
+	return "", ""
+}
+
+// findGitDir looks for the .git directory in dir or any of its parents,
+// returning it and the root of the work tree. It understands .git files, which
+// worktrees and submodules use to point to the real git directory.
+func findGitDir(dir string) (string, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		candidate := filepath.Join(dir, ".git")
+		if info, err := os.Stat(candidate); err == nil {
+			if info.IsDir() {
+				return candidate, dir, nil
+			}
+			data, err := os.ReadFile(candidate)
+			if err != nil {
+				return "", "", err
+			}
+			if target, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: "); ok {
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(dir, target)
+				}
+				return target, dir, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", errors.New("not in a git repository")
+		}
+		dir = parent
+	}
+}
+
+// commonDir returns the directory holding objects and refs shared between
+// worktrees, which is gitDir itself for a normal checkout.
+func commonDir(gitDir string) string {
+	data, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	common := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(gitDir, common)
+	}
+	return common
+}
+
+// resolveRef finds the commit a ref like refs/heads/main points to, looking
+// first for a loose ref and then in packed-refs.
+func resolveRef(gitDir string, ref string) (string, error) {
+	for _, d := range []string{gitDir, commonDir(gitDir)} {
+		if data, err := os.ReadFile(filepath.Join(d, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+	for name, sha := range packedRefs(gitDir) {
+		if name == ref {
+			return sha, nil
+		}
+	}
+	return "", fmt.Errorf("unable to resolve %s", ref)
+}
+
+// packedRefs reads the packed-refs file, returning the commit each ref points
+// to. Annotated tags are peeled to the commit they tag.
+func packedRefs(gitDir string) map[string]string {
+	refs := map[string]string{}
+	f, err := os.Open(filepath.Join(commonDir(gitDir), "packed-refs"))
+	if err != nil {
+		return refs
+	}
+	defer f.Close()
+
+	last := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "^"):
+			// the peeled value of the previous line's annotated tag
+			if last != "" {
+				refs[last] = strings.TrimPrefix(line, "^")
+			}
+		default:
+			if sha, name, ok := strings.Cut(line, " "); ok {
+				refs[name] = sha
+				last = name
+			}
+		}
+	}
+	return refs
+}
+
+// tagsAt returns the names of the tags pointing at the commit
+func tagsAt(gitDir string, sha string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for name, target := range packedRefs(gitDir) {
+		if tag, ok := strings.CutPrefix(name, "refs/tags/"); ok && target == sha {
+			tags = append(tags, tag)
+			seen[tag] = true
+		}
+	}
+
+	tagDir := filepath.Join(commonDir(gitDir), "refs", "tags")
+	filepath.WalkDir(tagDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(tagDir, p)
+		tag := filepath.ToSlash(rel)
+		data, err := os.ReadFile(p)
+		if err != nil || seen[tag] {
+			return nil
+		}
+		target := strings.TrimSpace(string(data))
+		if target != sha {
+			// it might be an annotated tag object pointing at the commit
+			obj, err := readObject(gitDir, target)
+			if err != nil || !bytes.HasPrefix(obj, []byte("object "+sha)) {
+				return nil
+			}
+		}
+		tags = append(tags, tag)
+		return nil
+	})
+	sort.Strings(tags)
+	return tags
+}
+
+// looseObjectTypes maps the type names in loose object headers to pack object
+// types
+var looseObjectTypes = map[string]int{
+	"commit": packCommit,
+	"tree":   packTree,
+	"blob":   packBlob,
+	"tag":    packTag,
+}
+
+// readLooseObject reads the type and body of an object that hasn't been
+// packed. Use readObject to read objects that may be in a pack file.
+func readLooseObject(gitDir string, sha string) (int, []byte, error) {
+	if len(sha) < 3 {
+		return 0, nil, fmt.Errorf("invalid object id %q", sha)
+	}
+	f, err := os.Open(filepath.Join(commonDir(gitDir), "objects", sha[:2], sha[2:]))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return 0, nil, err
+	}
+	// strip the "<type> <size>\0" header
+	header, body, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return 0, nil, fmt.Errorf("invalid object %s", sha)
+	}
+	name, _, _ := strings.Cut(string(header), " ")
+	typ, ok := looseObjectTypes[name]
+	if !ok {
+		return 0, nil, fmt.Errorf("invalid object %s", sha)
+	}
+	return typ, body, nil
+}
+
+// workTreeDirty compares the files in the work tree with the index, like
+// "git status --untracked-files=no". Files whose size and modification time
+// match the index are trusted to be unchanged, as git does; others are hashed.
+// Line ending conversion and other filters aren't applied, so they can make a
+// clean work tree look dirty.
+func workTreeDirty(gitDir string, workTree string) (bool, error) {
+	indexPath := filepath.Join(gitDir, "index")
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		return false, err
+	}
+	indexInfo, err := os.Stat(indexPath)
+	if err != nil {
+		return false, err
+	}
+	if len(index) < 12 || string(index[:4]) != "DIRC" {
+		return false, errors.New("invalid index")
+	}
+	version := binary.BigEndian.Uint32(index[4:8])
+	if version < 2 || version > 4 {
+		return false, fmt.Errorf("unsupported index version %d", version)
+	}
+	count := int(binary.BigEndian.Uint32(index[8:12]))
+
+	errTruncated := errors.New("truncated index")
+	pos := 12
+	name := ""
+	for i := 0; i < count; i++ {
+		start := pos
+		if len(index) < pos+62 {
+			return false, errTruncated
+		}
+		mtimeSec := binary.BigEndian.Uint32(index[pos+8:])
+		mtimeNsec := binary.BigEndian.Uint32(index[pos+12:])
+		mode := binary.BigEndian.Uint32(index[pos+24:])
+		size := binary.BigEndian.Uint32(index[pos+36:])
+		sha := index[pos+40 : pos+60]
+		flags := binary.BigEndian.Uint16(index[pos+60:])
+		pos += 62
+		var extended uint16
+		if version >= 3 && flags&0x4000 != 0 {
+			if len(index) < pos+2 {
+				return false, errTruncated
+			}
+			extended = binary.BigEndian.Uint16(index[pos:])
+			pos += 2
+		}
+
+		if version == 4 {
+			// the name replaces the end of the previous one
+			strip := 0
+			for {
+				if pos >= len(index) {
+					return false, errTruncated
+				}
+				c := index[pos]
+				pos++
+				strip = strip<<7 | int(c&0x7f)
+				if c&0x80 == 0 {
+					break
+				}
+				strip++
+			}
+			end := bytes.IndexByte(index[pos:], 0)
+			if end < 0 || strip > len(name) {
+				return false, errTruncated
+			}
+			name = name[:len(name)-strip] + string(index[pos:pos+end])
+			pos += end + 1
+		} else {
+			end := bytes.IndexByte(index[pos:], 0)
+			if end < 0 {
+				return false, errTruncated
+			}
+			name = string(index[pos : pos+end])
+			// entries are padded with NULs to a multiple of 8 bytes
+			pos = start + (pos+end-start+8)/8*8
+		}
+
+		switch {
+		case flags&0x3000 != 0:
+			// a merge conflict
+			return true, nil
+		case extended&0x4000 != 0:
+			// skip-worktree, as in a sparse checkout
+			continue
+		case extended&0x2000 != 0:
+			// intent-to-add, a new file
+			return true, nil
+		}
+
+		info, err := os.Lstat(filepath.Join(workTree, filepath.FromSlash(name)))
+		if err != nil {
+			return true, nil
+		}
+		var data []byte
+		switch mode & 0o170000 {
+		case 0o160000:
+			// submodules are left alone
+			continue
+		case 0o120000:
+			if info.Mode()&os.ModeSymlink == 0 {
+				return true, nil
+			}
+			target, err := os.Readlink(filepath.Join(workTree, filepath.FromSlash(name)))
+			if err != nil {
+				return true, nil
+			}
+			data = []byte(target)
+		default:
+			if !info.Mode().IsRegular() || (mode&0o111 != 0) != (info.Mode()&0o111 != 0) || uint32(info.Size()) != size {
+				return true, nil
+			}
+			modTime := info.ModTime()
+			// files changed in the same instant as the index was written may
+			// have changed since without the stat data showing it
+			if modTime.Unix() == int64(mtimeSec) && modTime.Nanosecond() == int(mtimeNsec) && modTime.Before(indexInfo.ModTime()) {
+				continue
+			}
+			if data, err = os.ReadFile(filepath.Join(workTree, filepath.FromSlash(name))); err != nil {
+				return true, nil
+			}
+		}
+		h := sha1.New()
+		fmt.Fprintf(h, "blob %d\x00", len(data))
+		h.Write(data)
+		if !bytes.Equal(h.Sum(nil), sha) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mergeBaseLimit bounds the number of commits we'll read looking for a merge
+// base. Every span with --git looks for it, including each cmd, so it has to
+// be cheap; branches are usually much shorter than this.
+const mergeBaseLimit = 1000
+
+// mergeBase finds the best common ancestor of two commits, or "" if there
+// isn't one in the history we have. Like git, it walks back from the second
+// commit newest first, so the first ancestor of the first commit it comes to
+// is the most recent one.
+func mergeBase(gitDir string, a string, b string) string {
+	ancestors := map[string]bool{}
+	queue := []string{a}
+	for len(queue) > 0 && len(ancestors) < mergeBaseLimit {
+		sha := queue[0]
+		queue = queue[1:]
+		if ancestors[sha] {
+			continue
+		}
+		ancestors[sha] = true
+		if commit, err := readObject(gitDir, sha); err == nil {
+			parents, _ := commitParents(commit)
+			queue = append(queue, parents...)
+		}
+	}
+
+	seen := map[string]bool{b: true}
+	pending := &commitQueue{}
+	heap.Push(pending, queuedCommit{sha: b})
+	for pending.Len() > 0 && len(seen) < mergeBaseLimit {
+		next := heap.Pop(pending).(queuedCommit)
+		if ancestors[next.sha] {
+			return next.sha
+		}
+		commit, err := readObject(gitDir, next.sha)
+		if err != nil {
+			// the history stops here in a shallow clone
+			continue
+		}
+		parents, _ := commitParents(commit)
+		for _, parent := range parents {
+			if seen[parent] {
+				continue
+			}
+			seen[parent] = true
+			var when time.Time
+			if obj, err := readObject(gitDir, parent); err == nil {
+				_, when = commitParents(obj)
+			}
+			heap.Push(pending, queuedCommit{sha: parent, when: when})
+		}
+	}
+	return ""
+}
+
+// queuedCommit is a commit waiting to be visited by mergeBase
+type queuedCommit struct {
+	sha  string
+	when time.Time
+}
+
+// commitQueue is a heap of commits, newest first
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int            { return len(q) }
+func (q commitQueue) Less(i, j int) bool  { return q[i].when.After(q[j].when) }
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
+
+// commitParents returns the parents and the committer time of a commit object
+func commitParents(commit []byte) ([]string, time.Time) {
+	var parents []string
+	var when time.Time
+	headers, _, _ := strings.Cut(string(commit), "\n\n")
+	for _, line := range strings.Split(headers, "\n") {
+		key, val, _ := strings.Cut(line, " ")
+		switch key {
+		case "parent":
+			parents = append(parents, val)
+		case "committer":
+			_, _, when = parseIdent(val)
+		}
+	}
+	return parents, when
+}
+
+// parseCommit pulls the author, committer time and subject out of a commit
+// object.
+func parseCommit(commit []byte) map[string]interface{} {
+	fields := map[string]interface{}{}
+	headers, message, _ := strings.Cut(string(commit), "\n\n")
+	for _, line := range strings.Split(headers, "\n") {
+		key, val, _ := strings.Cut(line, " ")
+		switch key {
+		case "author":
+			name, email, _ := parseIdent(val)
+			fields["git.author"] = name
+			fields["git.author_email"] = email
+		case "committer":
+			if _, _, ts := parseIdent(val); !ts.IsZero() {
+				fields["git.commit_time"] = ts.Format(time.RFC3339)
+			}
+		}
+	}
+	subject, _, _ := strings.Cut(message, "\n")
+	fields["git.subject"] = strings.TrimSpace(subject)
+	return fields
+}
+
+// parseIdent splits an identity line like "A U Thor <a@example.com> 1700000000
+// +0100" in to its parts.
+func parseIdent(ident string) (name, email string, ts time.Time) {
+	open := strings.Index(ident, "<")
+	closing := strings.Index(ident, ">")
+	if open < 0 || closing < open {
+		return strings.TrimSpace(ident), "", time.Time{}
+	}
+	name = strings.TrimSpace(ident[:open])
+	email = ident[open+1 : closing]
+	rest := strings.Fields(ident[closing+1:])
+	if len(rest) == 2 {
+		secs, err := strconv.ParseInt(rest[0], 10, 64)
+		if err == nil {
+			ts = time.Unix(secs, 0)
+			if offset, err := time.Parse("-0700", rest[1]); err == nil {
+				ts = ts.In(offset.Location())
+			}
+		}
+	}
+	return name, email, ts
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testGit returns a function that runs git in dir with a fixed identity and
+// commit date, returning its output
+func testGit(t *testing.T, dir string) func(args ...string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	return func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=A U Thor", "GIT_AUTHOR_EMAIL=author@example.com",
+			"GIT_COMMITTER_NAME=C O Mitter", "GIT_COMMITTER_EMAIL=committer@example.com",
+			"GIT_COMMITTER_DATE=2024-03-01T12:00:00+01:00",
+			"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+		)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return string(out)
+	}
+}
+
+// newTestRepo creates a repository with one tagged commit on main
+func newTestRepo(t *testing.T) string {
+	dir := t.TempDir()
+	git := testGit(t, dir)
+	git("init", "--quiet", "--initial-branch=main")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("hello\n"), 0644))
+	git("add", "README")
+	git("commit", "--quiet", "-m", "Initial commit", "-m", "With a body")
+	git("tag", "v1.0.0")
+	git("tag", "-a", "-m", "release", "release-1")
+	return dir
+}
+
+func TestGitInfo(t *testing.T) {
+	dir := newTestRepo(t)
+
+	fromExec, err := gitInfoExec(dir)
+	require.NoError(t, err)
+	fromFiles, err := gitInfoFiles(dir)
+	require.NoError(t, err)
+
+	for _, fields := range []map[string]interface{}{fromExec, fromFiles} {
+		assert.Len(t, fields["git.commit"], 40)
+		assert.Equal(t, "main", fields["git.branch"])
+		assert.Equal(t, "A U Thor", fields["git.author"])
+		assert.Equal(t, "author@example.com", fields["git.author_email"])
+		assert.Equal(t, "Initial commit", fields["git.subject"])
+		assert.Equal(t, "release-1,v1.0.0", fields["git.tags"])
+
+		ts, err := time.Parse(time.RFC3339, fields["git.commit_time"].(string))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1709290800), ts.Unix())
+	}
+	assert.Equal(t, fromExec["git.commit"], fromFiles["git.commit"])
+
+	assert.Equal(t, false, fromExec["git.dirty"])
+	assert.Equal(t, "main", fromExec["git.default_branch"])
+	assert.Equal(t, fromExec["git.commit"], fromExec["git.merge_base"])
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("changed\n"), 0644))
+	fromExec, err = gitInfoExec(dir)
+	require.NoError(t, err)
+	assert.Equal(t, true, fromExec["git.dirty"])
+}
+
+func TestGitInfoFilesPackedRefs(t *testing.T) {
+	dir := newTestRepo(t)
+	cmd := exec.Command("git", "pack-refs", "--all")
+	cmd.Dir = dir
+	require.NoError(t, cmd.Run())
+
+	fields, err := gitInfoFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "main", fields["git.branch"])
+	assert.Len(t, fields["git.commit"], 40)
+	assert.Equal(t, "release-1,v1.0.0", fields["git.tags"])
+}
+
+func TestGitInfoFilesPacked(t *testing.T) {
+	dir := newTestRepo(t)
+	git := testGit(t, dir)
+
+	// a file that changes a little in each commit, so the pack holds deltas
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("line %d of a file that compresses well as a delta", i))
+	}
+	commit := func(i int, msg string) {
+		lines[i*7] = fmt.Sprintf("changed in %q", msg)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "big.txt"), []byte(strings.Join(lines, "\n")), 0644))
+		git("add", "big.txt")
+		git("commit", "--quiet", "-m", msg)
+	}
+	for i := 0; i < 5; i++ {
+		commit(i, fmt.Sprintf("main %d", i))
+	}
+	git("checkout", "--quiet", "-b", "feature", "main~2")
+	for i := 5; i < 8; i++ {
+		commit(i, fmt.Sprintf("feature %d", i))
+	}
+	git("tag", "-a", "-m", "feature release", "feature-1")
+	git("gc", "--quiet", "--aggressive", "--prune=now")
+
+	objects, err := filepath.Glob(filepath.Join(dir, ".git", "objects", "??", "*"))
+	require.NoError(t, err)
+	require.Empty(t, objects, "all the objects should be packed")
+	gitDir := filepath.Join(dir, ".git")
+	require.Contains(t, git("verify-pack", "-v", packIndex(t, gitDir)), "chain length", "the pack should hold deltas")
+
+	// every version of the file can be rebuilt from the deltas
+	for _, rev := range []string{"main", "main~1", "main~4", "feature", "feature~1"} {
+		sha := strings.TrimSpace(git("rev-parse", rev+":big.txt"))
+		data, err := readObject(gitDir, sha)
+		require.NoError(t, err, rev)
+		assert.Equal(t, git("cat-file", "blob", sha), string(data), rev)
+	}
+
+	for _, version := range []string{"2", "3", "4"} {
+		t.Run("index version "+version, func(t *testing.T) {
+			git("update-index", "--index-version", version)
+
+			fromExec, err := gitInfoExec(dir)
+			require.NoError(t, err)
+			fromFiles, err := gitInfoFiles(dir)
+			require.NoError(t, err)
+			assert.Equal(t, fromExec, fromFiles)
+			assert.Equal(t, "feature 7", fromFiles["git.subject"])
+			assert.Equal(t, "feature-1", fromFiles["git.tags"])
+			assert.Equal(t, false, fromFiles["git.dirty"])
+			assert.Equal(t, "main", fromFiles["git.default_branch"])
+			assert.NotEmpty(t, fromFiles["git.merge_base"])
+			assert.NotEqual(t, fromFiles["git.commit"], fromFiles["git.merge_base"])
+		})
+	}
+
+	// the same size, so it has to be hashed to see the change
+	readme := filepath.Join(dir, "README")
+	require.NoError(t, os.WriteFile(readme, []byte("HELLO\n"), 0644))
+	fields, err := gitInfoFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, true, fields["git.dirty"])
+
+	require.NoError(t, os.WriteFile(readme, []byte("hello\n"), 0755))
+	require.NoError(t, os.Chmod(readme, 0755))
+	fields, err = gitInfoFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, true, fields["git.dirty"])
+
+	require.NoError(t, os.Remove(readme))
+	fields, err = gitInfoFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, true, fields["git.dirty"])
+}
+
+// packIndex returns the path of the only pack index in the repository
+func packIndex(t *testing.T, gitDir string) string {
+	idxs, err := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "*.idx"))
+	require.NoError(t, err)
+	require.Len(t, idxs, 1)
+	return idxs[0]
+}
+
+func TestParseIdent(t *testing.T) {
+	name, email, ts := parseIdent("A U Thor <a@example.com> 1700000000 -0500")
+	assert.Equal(t, "A U Thor", name)
+	assert.Equal(t, "a@example.com", email)
+	assert.Equal(t, int64(1700000000), ts.Unix())
+	_, offset := ts.Zone()
+	assert.Equal(t, -5*60*60, offset)
+}
+
+func TestGitInfoNotARepo(t *testing.T) {
+	_, err := gitInfoFiles(t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestGitInfoExecTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script standing in for git")
+	}
+	// a git that hangs, as it does waiting on a lock or a credential helper
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not installed")
+	}
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "git"), []byte("#!/bin/sh\nexec "+sleep+" 30\n"), 0755))
+	t.Setenv("PATH", bin)
+
+	defer func(timeout time.Duration) { gitTimeout = timeout }(gitTimeout)
+	gitTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err = gitInfoExec(t.TempDir())
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), gitTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
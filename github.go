@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// githubEvent holds the parts of the GitHub Actions event payload we use. See
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads
+type githubEvent struct {
+	PullRequest *struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		User   struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Labels []struct {
+			Name string `json:"name"`
+		} `json:"labels"`
+		Head githubRef `json:"head"`
+		Base githubRef `json:"base"`
+	} `json:"pull_request"`
+}
+
+type githubRef struct {
+	Ref  string `json:"ref"`
+	SHA  string `json:"sha"`
+	Repo struct {
+		FullName string `json:"full_name"`
+		Fork     bool   `json:"fork"`
+	} `json:"repo"`
+}
+
+// githubEventInfo adds fields from the event that triggered a GitHub Actions
+// workflow. GITHUB_REF is refs/pull/12/merge for pull requests and
+// GITHUB_ACTOR is whoever triggered the run, so for pull requests we replace
+// the branch and pr_user fields with the real head branch and author.
+func githubEventInfo(ev *libhoney.Event) {
+	// for everything other than pull requests, the branch is the ref name
+	if os.Getenv("GITHUB_REF_TYPE") == "branch" {
+		if name, ok := os.LookupEnv("GITHUB_REF_NAME"); ok {
+			ev.AddField("branch", name)
+		}
+	}
+	if sha, ok := os.LookupEnv("GITHUB_SHA"); ok {
+		ev.AddField("commit", sha)
+	}
+
+	loc := os.Getenv("GITHUB_EVENT_PATH")
+	if loc == "" {
+		return
+	}
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read %q: %v\n", loc, err)
+		return
+	}
+	var event githubEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		fmt.Fprintf(os.Stderr, "problems loading from %q: %v\n", loc, err)
+		return
+	}
+
+	pr := event.PullRequest
+	if pr == nil {
+		return
+	}
+	labels := make([]string, 0, len(pr.Labels))
+	for _, label := range pr.Labels {
+		labels = append(labels, label.Name)
+	}
+	ev.Add(map[string]interface{}{
+		"branch":           pr.Head.Ref,
+		"commit":           pr.Head.SHA,
+		"pr_number":        strconv.Itoa(pr.Number), // a string, like every other provider
+		"pr_title":         pr.Title,
+		"pr_user":          pr.User.Login,
+		"pr_branch":        pr.Head.Ref,
+		"pr_target_branch": pr.Base.Ref,
+		"pr_repo":          pr.Head.Repo.FullName,
+		"pr_labels":        strings.Join(labels, ","),
+		"pr_fork":          pr.Head.Repo.Fork || pr.Head.Repo.FullName != pr.Base.Repo.FullName,
+	})
+}
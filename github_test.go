@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+func TestGithubEventInfo(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "event.json")
+	err := os.WriteFile(loc, []byte(`{
+		"action": "synchronize",
+		"number": 12,
+		"pull_request": {
+			"number": 12,
+			"title": "Add a thing",
+			"user": {"login": "octocat"},
+			"labels": [{"name": "bug"}, {"name": "ci"}],
+			"head": {"ref": "feature", "sha": "abc123", "repo": {"full_name": "octocat/repo", "fork": true}},
+			"base": {"ref": "main", "sha": "def456", "repo": {"full_name": "org/repo", "fork": false}}
+		}
+	}`), 0644)
+	assert.NoError(t, err)
+
+	t.Setenv("GITHUB_EVENT_PATH", loc)
+	t.Setenv("GITHUB_REF_TYPE", "")
+	t.Setenv("GITHUB_SHA", "merge789")
+
+	ev := libhoney.NewEvent()
+	githubEventInfo(ev)
+	fields := ev.Fields()
+	assert.Equal(t, "feature", fields["branch"])
+	assert.Equal(t, "abc123", fields["commit"])
+	assert.Equal(t, "12", fields["pr_number"])
+	assert.Equal(t, "octocat", fields["pr_user"])
+	assert.Equal(t, "main", fields["pr_target_branch"])
+	assert.Equal(t, "bug,ci", fields["pr_labels"])
+	assert.Equal(t, true, fields["pr_fork"])
+}
+
+func TestGithubEventInfoPush(t *testing.T) {
+	loc := filepath.Join(t.TempDir(), "event.json")
+	assert.NoError(t, os.WriteFile(loc, []byte(`{"ref": "refs/heads/main", "after": "abc123"}`), 0644))
+
+	t.Setenv("GITHUB_EVENT_PATH", loc)
+	t.Setenv("GITHUB_REF_TYPE", "branch")
+	t.Setenv("GITHUB_REF_NAME", "main")
+	t.Setenv("GITHUB_SHA", "abc123")
+
+	ev := libhoney.NewEvent()
+	githubEventInfo(ev)
+	fields := ev.Fields()
+	assert.Equal(t, "main", fields["branch"])
+	assert.Equal(t, "abc123", fields["commit"])
+	assert.NotContains(t, fields, "pr_number")
+}
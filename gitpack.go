@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// pack object types, from the object header in a pack file
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+// maxDeltaChain bounds how many deltas we'll follow to find an object's base,
+// so that a corrupt pack can't send us round in circles. git itself defaults
+// to chains of at most 50.
+const maxDeltaChain = 1000
+
+// packIndexes caches the contents of the pack index files, which are searched
+// for every object we read
+var packIndexes = struct {
+	sync.Mutex
+	data map[string][]byte
+}{data: map[string][]byte{}}
+
+// errObjectNotFound is returned when an object isn't in any pack
+var errObjectNotFound = errors.New("object not found")
+
+// readObject reads the body of an object, whether it's loose or in a pack
+// file. Only SHA-1 repositories are supported.
+func readObject(gitDir string, sha string) ([]byte, error) {
+	_, data, err := readObjectType(gitDir, sha)
+	return data, err
+}
+
+// readObjectType reads an object along with its type, one of the pack object
+// types.
+func readObjectType(gitDir string, sha string) (int, []byte, error) {
+	if typ, data, err := readLooseObject(gitDir, sha); err == nil {
+		return typ, data, nil
+	}
+	return readPackedObject(gitDir, sha)
+}
+
+// readPackedObject looks for the object in each of the repository's pack
+// files.
+func readPackedObject(gitDir string, sha string) (int, []byte, error) {
+	id, err := hex.DecodeString(sha)
+	if err != nil || len(id) != 20 {
+		return 0, nil, fmt.Errorf("invalid object id %q", sha)
+	}
+	idxs, _ := filepath.Glob(filepath.Join(commonDir(gitDir), "objects", "pack", "pack-*.idx"))
+	for _, idx := range idxs {
+		offset, err := packIndexOffset(idx, id)
+		if errors.Is(err, errObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		pack, err := os.Open(idx[:len(idx)-len(".idx")] + ".pack")
+		if err != nil {
+			return 0, nil, err
+		}
+		defer pack.Close()
+		return readPackObject(gitDir, pack, offset, 0)
+	}
+	return 0, nil, fmt.Errorf("object %s: %w", sha, errObjectNotFound)
+}
+
+// packIndexOffset finds where the object is in the pack file using its
+// version 2 index.
+func packIndexOffset(idxPath string, id []byte) (int64, error) {
+	idx, err := readPackIndex(idxPath)
+	if err != nil {
+		return 0, err
+	}
+	const header = 8
+	const fanoutSize = 256 * 4
+	if len(idx) < header+fanoutSize || !bytes.Equal(idx[:4], []byte("\377tOc")) || binary.BigEndian.Uint32(idx[4:8]) != 2 {
+		return 0, fmt.Errorf("%s: unsupported pack index", idxPath)
+	}
+	fanout := idx[header : header+fanoutSize]
+	count := int(binary.BigEndian.Uint32(fanout[255*4:]))
+	shas := header + fanoutSize
+	crcs := shas + count*20
+	offsets := crcs + count*4
+	largeOffsets := offsets + count*4
+	if len(idx) < largeOffsets {
+		return 0, fmt.Errorf("%s: truncated pack index", idxPath)
+	}
+
+	// the fanout table says how many objects have a first byte less than or
+	// equal to each value, which narrows down the range to search
+	lo := 0
+	if id[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(fanout[(int(id[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(fanout[int(id[0])*4:]))
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx[shas+(lo+i)*20:shas+(lo+i+1)*20], id) >= 0
+	})
+	if i >= hi || !bytes.Equal(idx[shas+i*20:shas+(i+1)*20], id) {
+		return 0, errObjectNotFound
+	}
+
+	offset := binary.BigEndian.Uint32(idx[offsets+i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset), nil
+	}
+	// the offset is too big for 31 bits, so it's in the table of 64 bit ones
+	large := largeOffsets + int(offset&0x7fffffff)*8
+	if len(idx) < large+8 {
+		return 0, fmt.Errorf("%s: truncated pack index", idxPath)
+	}
+	return int64(binary.BigEndian.Uint64(idx[large:])), nil
+}
+
+// readPackIndex reads a pack index file, or returns it from the cache
+func readPackIndex(idxPath string) ([]byte, error) {
+	packIndexes.Lock()
+	defer packIndexes.Unlock()
+	if idx, ok := packIndexes.data[idxPath]; ok {
+		return idx, nil
+	}
+	idx, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	packIndexes.data[idxPath] = idx
+	return idx, nil
+}
+
+// readPackObject reads the object at offset in the pack, applying deltas to
+// rebuild it. It returns the type of the object and its body.
+func readPackObject(gitDir string, pack *os.File, offset int64, depth int) (int, []byte, error) {
+	if depth > maxDeltaChain {
+		return 0, nil, errors.New("pack delta chain is too long")
+	}
+	r := bufio.NewReader(io.NewSectionReader(pack, offset, 1<<62))
+
+	// the header holds the type and the inflated size in a variable number
+	// of bytes
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	typ := int(c>>4) & 7
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var baseType int
+	var base []byte
+	switch typ {
+	case packCommit, packTree, packBlob, packTag:
+	case packOfsDelta:
+		// the base is an earlier object in the same pack
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		if rel <= 0 || rel > offset {
+			return 0, nil, errors.New("invalid pack delta offset")
+		}
+		if baseType, base, err = readPackObject(gitDir, pack, offset-rel, depth+1); err != nil {
+			return 0, nil, err
+		}
+	case packRefDelta:
+		// the base is named by its ID, and might be anywhere
+		id := make([]byte, 20)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return 0, nil, err
+		}
+		if baseType, base, err = readObjectType(gitDir, hex.EncodeToString(id)); err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, fmt.Errorf("unknown pack object type %d", typ)
+	}
+
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if base == nil {
+		return typ, data, nil
+	}
+	data, err = applyDelta(base, data)
+	return baseType, data, err
+}
+
+// applyDelta rebuilds an object from its base and a git delta, which is a
+// series of instructions to either copy a range of the base or insert new
+// data.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	errInvalid := errors.New("invalid pack delta")
+	varint := func() (int, bool) {
+		n, shift := 0, 0
+		for len(delta) > 0 {
+			c := delta[0]
+			delta = delta[1:]
+			n |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				return n, true
+			}
+		}
+		return 0, false
+	}
+
+	srcSize, ok := varint()
+	if !ok || srcSize != len(base) {
+		return nil, errInvalid
+	}
+	dstSize, ok := varint()
+	if !ok {
+		return nil, errInvalid
+	}
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			// copy from the base; the low bits say which offset and size
+			// bytes follow
+			var offset, size int
+			for i := 0; i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errInvalid
+					}
+					offset |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errInvalid
+					}
+					size |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > len(base) {
+				return nil, errInvalid
+			}
+			out = append(out, base[offset:offset+size]...)
+		case op != 0:
+			// insert the next op bytes
+			if int(op) > len(delta) {
+				return nil, errInvalid
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errInvalid
+		}
+	}
+	if len(out) != dstSize {
+		return nil, errInvalid
+	}
+	return out, nil
+}
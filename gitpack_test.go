@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello, world")
+	// a 12 byte base and 13 byte result: copy 5 bytes from offset 0, insert
+	// 6 bytes, then copy 2 bytes from offset 10
+	delta := []byte{12, 13, 0x90, 5, 6, ' ', 't', 'h', 'e', 'r', 'e', 0x91, 10, 2}
+	out, err := applyDelta(base, delta)
+	require.NoError(t, err)
+	assert.Equal(t, "hello thereld", string(out))
+
+	_, err = applyDelta(base, []byte{11, 5, 0x90, 5})
+	assert.Error(t, err, "wrong base size")
+	_, err = applyDelta(base, []byte{12, 5, 0x91, 10, 5})
+	assert.Error(t, err, "copy past the end of the base")
+	_, err = applyDelta(base, []byte{12, 5, 0x90, 4})
+	assert.Error(t, err, "wrong result size")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// unlimitedMemory is the smallest cgroup v1 memory limit we treat as no limit
+// at all; the kernel reports "unlimited" as a huge page aligned number.
+const unlimitedMemory = 1 << 62
+
+// hostInfo gathers facts about the machine running the build, so that slow
+// builds can be explained by the class of runner they ran on. Most of it comes
+// from /proc and /sys, which only exist on Linux; elsewhere we add what we can
+// from the Go runtime. Facts that can't be determined are left out. fsys is
+// the root filesystem.
+func hostInfo(fsys fs.FS, lookupEnv func(string) (string, bool)) map[string]interface{} {
+	fields := map[string]interface{}{
+		"meta.cpu_count": runtime.NumCPU(),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		fields["meta.hostname"] = hostname
+	}
+	if model := cpuModel(fsys); model != "" {
+		fields["meta.cpu_model"] = model
+	}
+	if mem := memTotal(fsys); mem > 0 {
+		fields["meta.memory_bytes"] = mem
+	}
+	if kernel := readTrimmed(fsys, "proc/sys/kernel/osrelease"); kernel != "" {
+		fields["meta.kernel_version"] = kernel
+	}
+
+	runtimeName := containerRuntime(fsys, lookupEnv)
+	fields["meta.container"] = runtimeName != ""
+	if runtimeName != "" {
+		fields["meta.container_runtime"] = runtimeName
+	}
+	_, k8s := lookupEnv("KUBERNETES_SERVICE_HOST")
+	fields["meta.kubernetes"] = k8s
+
+	if cpus, ok := cgroupCPULimit(fsys); ok {
+		fields["meta.cgroup_cpu_limit"] = cpus
+	}
+	if mem, ok := cgroupMemoryLimit(fsys); ok {
+		fields["meta.cgroup_memory_limit_bytes"] = mem
+	}
+	return fields
+}
+
+// readTrimmed returns the contents of the file without surrounding whitespace,
+// or "" if it can't be read.
+func readTrimmed(fsys fs.FS, name string) string {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// procValue returns the value of the first "key : value" line in a /proc file
+// with one of the given keys
+func procValue(fsys fs.FS, name string, keys ...string) string {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		for _, k := range keys {
+			if key == k {
+				return strings.TrimSpace(val)
+			}
+		}
+	}
+	return ""
+}
+
+// cpuModel returns the name of the CPU. ARM machines don't have a model name,
+// so we fall back to the name of the hardware.
+func cpuModel(fsys fs.FS) string {
+	return procValue(fsys, "proc/cpuinfo", "model name", "Hardware", "Model")
+}
+
+// memTotal returns the total memory of the machine in bytes
+func memTotal(fsys fs.FS) int64 {
+	// reported as "MemTotal:       16318252 kB"
+	kb, err := strconv.ParseInt(strings.TrimSuffix(procValue(fsys, "proc/meminfo", "MemTotal"), " kB"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return kb * 1024
+}
+
+// containerRuntime returns the name of the container runtime we're running
+// in, or "" if we don't seem to be in a container.
+func containerRuntime(fsys fs.FS, lookupEnv func(string) (string, bool)) string {
+	if _, err := fs.Stat(fsys, ".dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := fs.Stat(fsys, "run/.containerenv"); err == nil {
+		return "podman"
+	}
+	// set by systemd-nspawn, podman and others
+	if name, ok := lookupEnv("container"); ok && name != "" {
+		return name
+	}
+	cgroup := readTrimmed(fsys, "proc/1/cgroup")
+	for _, name := range []string{"docker", "kubepods", "containerd", "crio", "lxc"} {
+		if strings.Contains(cgroup, name) {
+			if name == "kubepods" {
+				return "kubernetes"
+			}
+			return name
+		}
+	}
+	if _, ok := lookupEnv("KUBERNETES_SERVICE_HOST"); ok {
+		return "kubernetes"
+	}
+	return ""
+}
+
+// cgroupCPULimit returns the number of CPUs the cgroup quota allows, if there
+// is a quota. It understands both cgroup v2 and v1.
+func cgroupCPULimit(fsys fs.FS) (float64, bool) {
+	// v2: "max 100000" or "200000 100000"
+	if max := strings.Fields(readTrimmed(fsys, "sys/fs/cgroup/cpu.max")); len(max) == 2 {
+		return cpuQuota(max[0], max[1])
+	}
+	// v1: a quota of -1 means no limit
+	return cpuQuota(
+		readTrimmed(fsys, "sys/fs/cgroup/cpu/cpu.cfs_quota_us"),
+		readTrimmed(fsys, "sys/fs/cgroup/cpu/cpu.cfs_period_us"),
+	)
+}
+
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// cgroupMemoryLimit returns the cgroup memory limit in bytes, if there is one.
+// It understands both cgroup v2 and v1.
+func cgroupMemoryLimit(fsys fs.FS) (int64, bool) {
+	limit := readTrimmed(fsys, "sys/fs/cgroup/memory.max")
+	if limit == "" {
+		limit = readTrimmed(fsys, "sys/fs/cgroup/memory/memory.limit_in_bytes")
+	}
+	mem, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil || mem <= 0 || mem >= unlimitedMemory {
+		return 0, false
+	}
+	return mem, true
+}
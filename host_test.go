@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostInfo(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		files  fstest.MapFS
+		env    map[string]string
+		expect map[string]interface{}
+		absent []string
+	}{
+		{
+			desc: "docker with cgroup v2 limits",
+			files: fstest.MapFS{
+				"proc/cpuinfo":              {Data: []byte("processor\t: 0\nvendor_id\t: GenuineIntel\nmodel name\t: Intel(R) Xeon(R) CPU @ 2.20GHz\n")},
+				"proc/meminfo":              {Data: []byte("MemTotal:       16318252 kB\nMemFree:         1000000 kB\n")},
+				"proc/sys/kernel/osrelease": {Data: []byte("6.1.0-18-amd64\n")},
+				".dockerenv":                {},
+				"sys/fs/cgroup/cpu.max":     {Data: []byte("200000 100000\n")},
+				"sys/fs/cgroup/memory.max":  {Data: []byte("4294967296\n")},
+			},
+			expect: map[string]interface{}{
+				"meta.cpu_model":                 "Intel(R) Xeon(R) CPU @ 2.20GHz",
+				"meta.memory_bytes":              int64(16318252 * 1024),
+				"meta.kernel_version":            "6.1.0-18-amd64",
+				"meta.container":                 true,
+				"meta.container_runtime":         "docker",
+				"meta.kubernetes":                false,
+				"meta.cgroup_cpu_limit":          2.0,
+				"meta.cgroup_memory_limit_bytes": int64(4294967296),
+			},
+		},
+		{
+			desc: "kubernetes with cgroup v1 limits",
+			files: fstest.MapFS{
+				"proc/1/cgroup":                              {Data: []byte("12:memory:/kubepods/burstable/pod1234/abcd\n")},
+				"sys/fs/cgroup/cpu/cpu.cfs_quota_us":         {Data: []byte("50000\n")},
+				"sys/fs/cgroup/cpu/cpu.cfs_period_us":        {Data: []byte("100000\n")},
+				"sys/fs/cgroup/memory/memory.limit_in_bytes": {Data: []byte("9223372036854771712\n")},
+			},
+			env: map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1"},
+			expect: map[string]interface{}{
+				"meta.container":         true,
+				"meta.container_runtime": "kubernetes",
+				"meta.kubernetes":        true,
+				"meta.cgroup_cpu_limit":  0.5,
+			},
+			absent: []string{"meta.cgroup_memory_limit_bytes", "meta.cpu_model"},
+		},
+		{
+			desc: "no limits outside a container",
+			files: fstest.MapFS{
+				"proc/cpuinfo":             {Data: []byte("processor\t: 0\nHardware\t: BCM2835\n")},
+				"proc/1/cgroup":            {Data: []byte("0::/init.scope\n")},
+				"sys/fs/cgroup/cpu.max":    {Data: []byte("max 100000\n")},
+				"sys/fs/cgroup/memory.max": {Data: []byte("max\n")},
+			},
+			expect: map[string]interface{}{
+				"meta.cpu_model":  "BCM2835",
+				"meta.container":  false,
+				"meta.kubernetes": false,
+			},
+			absent: []string{"meta.container_runtime", "meta.cgroup_cpu_limit", "meta.cgroup_memory_limit_bytes", "meta.memory_bytes"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			fields := hostInfo(tC.files, fakeEnv(tC.env))
+			assert.Contains(t, fields, "meta.cpu_count")
+			for k, v := range tC.expect {
+				assert.Equal(t, v, fields[k], k)
+			}
+			for _, k := range tC.absent {
+				assert.NotContains(t, fields, k)
+			}
+		})
+	}
+}
@@ -18,10 +18,19 @@ const (
 	providerGitLab             = "GitLab-CI"
 	providerBuildkite          = "Buildkite"
 	providerJenkinsX           = "Jenkins-X"
+	providerJenkins            = "Jenkins"
 	providerGoogleCloudBuild   = "Google-Cloud-Build"
 	providerAzurePipelines     = "Azure-Pipelines"
 	providerGitHubActions      = "GitHub-Actions"
 	providerBitbucketPipelines = "Bitbucket-Pipelines"
+	providerDrone              = "Drone"
+	providerWoodpecker         = "Woodpecker"
+	providerTeamCity           = "TeamCity"
+	providerSemaphore          = "Semaphore"
+	providerCodeBuild          = "AWS-CodeBuild"
+	providerAppVeyor           = "AppVeyor"
+	providerHarness            = "Harness"
+	providerTekton             = "Tekton"
 )
 
 func main() {
@@ -29,17 +38,25 @@ func main() {
 	var config libhoney.Config
 	var filename string
 	var ciProvider string
+	var ecfg eventConfig
 	var wcfg watchConfig
+	var bcfg backfillConfig
+	var dcfg diffConfig
+	var qcfg queueConfig
+	var scfg spanConfig
 	var serviceName string
 
-	root := commandRoot(&config, &filename, &ciProvider, &serviceName)
+	root := commandRoot(&config, &ecfg, &filename, &ciProvider, &serviceName)
 
 	// Put 'em all together
 	root.AddCommand(
-		commandBuild(&config, &filename, &ciProvider),
-		commandStep(&config, &filename, &ciProvider),
-		commandCmd(&config, &filename, &ciProvider),
-		commandWatch(&config, &filename, &ciProvider, &wcfg),
+		commandBuild(&config, &ecfg, &filename, &ciProvider, &dcfg),
+		commandStep(&config, &ecfg, &filename, &ciProvider, &dcfg, &qcfg),
+		commandCmd(&config, &ecfg, &filename, &ciProvider),
+		commandWatch(&config, &ecfg, &filename, &ciProvider, &wcfg),
+		commandSpan(&config, &ecfg, &filename, &ciProvider, &scfg),
+		commandBackfill(&config, &ecfg, &bcfg),
+		commandDetect(&ciProvider),
 	)
 
 	// Do the work
@@ -0,0 +1,313 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// embeddedProviders holds the field mappings for the CI providers we know
+// about out of the box.
+//
+//go:embed providers.yaml
+var embeddedProviders []byte
+
+// providerDef describes how to gather fields for a CI provider
+type providerDef struct {
+	// Name is the canonical name of the provider, used for the ci_provider field
+	Name string `yaml:"name"`
+	// Aliases are other names that may be used to select this provider
+	Aliases []string `yaml:"aliases"`
+	// TraceID is the environment variable we recommend using as the trace ID
+	TraceID string `yaml:"trace_id"`
+	// Detect lists the environment variables that indicate we're running in
+	// this provider
+	Detect []detectRule `yaml:"detect"`
+	// Fields maps environment variable names to event field names
+	Fields map[string]string `yaml:"fields"`
+	// Templates maps event field names to values built from several
+	// environment variables, such as "${HOST}/builds/${ID}". The field is only
+	// added if all the variables it refers to are set.
+	Templates map[string]string `yaml:"templates"`
+}
+
+// detectRule is one piece of evidence that we're running in a provider
+type detectRule struct {
+	// Env is the environment variable that must be set
+	Env string `yaml:"env"`
+	// Value, if not empty, is the value (ignoring case) Env must have
+	Value string `yaml:"value"`
+	// Weight is how much this rule counts towards detecting the provider. It
+	// defaults to minDetectScore, so that one rule is enough on its own.
+	Weight int `yaml:"weight"`
+}
+
+// minDetectScore is the lowest score that counts as detecting a provider
+const minDetectScore = 10
+
+// providerEnrichers add fields for a provider that can't be expressed as a
+// simple mapping from environment variables, keyed by provider name.
+var providerEnrichers = map[string]func(*libhoney.Event){
+	providerGitHubActions: githubEventInfo,
+}
+
+type providerFile struct {
+	Providers []*providerDef `yaml:"providers"`
+}
+
+// providers is the registry of known CI providers. It starts out with the
+// embedded definitions and may be extended by a user supplied file with
+// loadProviderMap.
+var providers = mustParseProviders(embeddedProviders)
+
+func mustParseProviders(data []byte) []*providerDef {
+	defs, err := parseProviders(data)
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded provider definitions: %v", err))
+	}
+	return defs
+}
+
+// parseProviders reads a list of provider definitions from YAML or JSON
+func parseProviders(data []byte) ([]*providerDef, error) {
+	var pf providerFile
+	if err := yaml.Unmarshal(data, &pf); err != nil {
+		return nil, err
+	}
+	for i, def := range pf.Providers {
+		if def == nil || def.Name == "" {
+			return nil, fmt.Errorf("provider %d has no name", i)
+		}
+	}
+	return pf.Providers, nil
+}
+
+// matches returns true if name is this provider's name or one of its aliases
+func (p *providerDef) matches(name string) bool {
+	if strings.EqualFold(p.Name, name) {
+		return true
+	}
+	for _, alias := range p.Aliases {
+		if strings.EqualFold(alias, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupProvider finds the provider with the given name or alias, ignoring
+// case. It returns nil if there is no such provider.
+func lookupProvider(name string) *providerDef {
+	if name == "" {
+		return nil
+	}
+	for _, def := range providers {
+		if def.matches(name) {
+			return def
+		}
+	}
+	return nil
+}
+
+// loadProviderMap reads a user supplied YAML or JSON file of provider
+// definitions and merges it in to the registry. Definitions for a provider we
+// already know about add aliases and add or rename fields; mapping an
+// environment variable to an empty field name removes it. Definitions for new
+// providers are added as they are.
+func loadProviderMap(loc string) error {
+	if loc == "" {
+		return nil
+	}
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		return err
+	}
+	defs, err := parseProviders(data)
+	if err != nil {
+		return fmt.Errorf("problems loading from %q: %w", loc, err)
+	}
+	providers = mergeProviders(providers, defs)
+	return nil
+}
+
+func mergeProviders(base []*providerDef, overrides []*providerDef) []*providerDef {
+	merged := make([]*providerDef, 0, len(base)+len(overrides))
+	for _, def := range base {
+		// copy so we never modify the definitions we were given
+		cp := &providerDef{
+			Name:      def.Name,
+			Aliases:   append([]string(nil), def.Aliases...),
+			TraceID:   def.TraceID,
+			Detect:    append([]detectRule(nil), def.Detect...),
+			Fields:    map[string]string{},
+			Templates: map[string]string{},
+		}
+		for envVar, field := range def.Fields {
+			cp.Fields[envVar] = field
+		}
+		for field, tmpl := range def.Templates {
+			cp.Templates[field] = tmpl
+		}
+		merged = append(merged, cp)
+	}
+
+	for _, override := range overrides {
+		var target *providerDef
+		for _, def := range merged {
+			if def.matches(override.Name) {
+				target = def
+				break
+			}
+		}
+		if target == nil {
+			target = &providerDef{Name: override.Name, Fields: map[string]string{}, Templates: map[string]string{}}
+			merged = append(merged, target)
+		}
+		if override.TraceID != "" {
+			target.TraceID = override.TraceID
+		}
+		target.Aliases = append(target.Aliases, override.Aliases...)
+		target.Detect = append(target.Detect, override.Detect...)
+		for envVar, field := range override.Fields {
+			if field == "" {
+				delete(target.Fields, envVar)
+				continue
+			}
+			target.Fields[envVar] = field
+		}
+		for field, tmpl := range override.Templates {
+			if tmpl == "" {
+				delete(target.Templates, field)
+				continue
+			}
+			target.Templates[field] = tmpl
+		}
+	}
+	return merged
+}
+
+// providerMatch is how well the environment matches a provider
+type providerMatch struct {
+	def     *providerDef
+	score   int
+	reasons []string
+}
+
+// scoreProviders checks every provider's detection rules against the
+// environment and returns those with any matching rules, best match first.
+func scoreProviders(lookupEnv func(string) (string, bool)) []providerMatch {
+	var matches []providerMatch
+	for _, def := range providers {
+		m := providerMatch{def: def}
+		for _, rule := range def.Detect {
+			val, ok := lookupEnv(rule.Env)
+			if !ok || (rule.Value != "" && !strings.EqualFold(val, rule.Value)) {
+				continue
+			}
+			weight := rule.Weight
+			if weight == 0 {
+				weight = minDetectScore
+			}
+			m.score += weight
+			if rule.Value != "" {
+				m.reasons = append(m.reasons, fmt.Sprintf("%s=%s (+%d)", rule.Env, val, weight))
+			} else {
+				m.reasons = append(m.reasons, fmt.Sprintf("%s is set (+%d)", rule.Env, weight))
+			}
+		}
+		if m.score > 0 {
+			matches = append(matches, m)
+		}
+	}
+	// stable, so that ties go to the provider listed first
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	return matches
+}
+
+// detectProvider returns the provider that best matches the environment, or
+// nil if none match well enough.
+func detectProvider(lookupEnv func(string) (string, bool)) *providerDef {
+	matches := scoreProviders(lookupEnv)
+	if len(matches) == 0 || matches[0].score < minDetectScore {
+		return nil
+	}
+	return matches[0].def
+}
+
+// resolveProvider returns the provider given on the command line or in the
+// environment, or if none was given, the canonical name of the one detected.
+// A provider that was given is kept as it is, since it ends up in the
+// ci_provider field; use lookupProvider or canonicalProvider to find out which
+// provider it refers to.
+func resolveProvider(provider string) string {
+	if provider != "" {
+		return provider
+	}
+	if def := detectProvider(os.LookupEnv); def != nil {
+		return def.Name
+	}
+	return ""
+}
+
+// canonicalProvider returns the canonical name of the provider with the given
+// name or alias. Unknown providers are passed through unchanged.
+func canonicalProvider(provider string) string {
+	if def := lookupProvider(provider); def != nil {
+		return def.Name
+	}
+	return provider
+}
+
+// providerField is a field that a provider adds to events
+type providerField struct {
+	name string
+	// envVar is the environment variable the value came from, or the
+	// template it was built with
+	envVar string
+	value  string
+}
+
+// providerFields returns the fields this provider would add to an event given
+// the environment, sorted by field name.
+func providerFields(def *providerDef, lookupEnv func(string) (string, bool)) []providerField {
+	var fields []providerField
+	for envVar, name := range def.Fields {
+		if val, ok := lookupEnv(envVar); ok {
+			fields = append(fields, providerField{name: name, envVar: envVar, value: val})
+		}
+	}
+	for name, tmpl := range def.Templates {
+		if val, ok := expandTemplate(tmpl, lookupEnv); ok {
+			fields = append(fields, providerField{name: name, envVar: tmpl, value: val})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].name == fields[j].name {
+			return fields[i].envVar < fields[j].envVar
+		}
+		return fields[i].name < fields[j].name
+	})
+	return fields
+}
+
+// expandTemplate replaces ${VAR} references in tmpl with their values from the
+// environment. It returns false if any of them are not set.
+func expandTemplate(tmpl string, lookupEnv func(string) (string, bool)) (string, bool) {
+	complete := true
+	val := os.Expand(tmpl, func(key string) string {
+		v, ok := lookupEnv(key)
+		if !ok {
+			complete = false
+		}
+		return v
+	})
+	return val, complete
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupProvider(t *testing.T) {
+	for _, name := range []string{"CircleCI", "circleci", "circle-ci", "circle"} {
+		def := lookupProvider(name)
+		if assert.NotNil(t, def, name) {
+			assert.Equal(t, providerCircle, def.Name)
+		}
+	}
+	assert.Nil(t, lookupProvider(""))
+	assert.Nil(t, lookupProvider("not-a-ci"))
+}
+
+func TestLoadProviderMap(t *testing.T) {
+	orig := providers
+	defer func() { providers = orig }()
+
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "providers.json")
+	err := os.WriteFile(loc, []byte(`{"providers": [
+		{"name": "Internal-CI", "aliases": ["ici"], "fields": {"ICI_BRANCH": "branch"}},
+		{"name": "circle", "aliases": ["cci"], "fields": {"CIRCLE_TAG": "tag", "CIRCLE_PR_USER": "author", "CIRCLE_BUILD_URL": ""}}
+	]}`), 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, loadProviderMap(loc))
+
+	internal := lookupProvider("ici")
+	if assert.NotNil(t, internal) {
+		assert.Equal(t, "Internal-CI", internal.Name)
+		assert.Equal(t, map[string]string{"ICI_BRANCH": "branch"}, internal.Fields)
+	}
+
+	circle := lookupProvider("cci")
+	if assert.NotNil(t, circle) {
+		assert.Equal(t, providerCircle, circle.Name)
+		assert.Equal(t, "tag", circle.Fields["CIRCLE_TAG"])
+		assert.Equal(t, "author", circle.Fields["CIRCLE_PR_USER"])
+		assert.NotContains(t, circle.Fields, "CIRCLE_BUILD_URL")
+		assert.Equal(t, "branch", circle.Fields["CIRCLE_BRANCH"])
+	}
+
+	// the embedded definitions are left alone
+	for _, def := range orig {
+		if def.Name == providerCircle {
+			assert.Equal(t, "pr_user", def.Fields["CIRCLE_PR_USER"])
+			assert.Contains(t, def.Fields, "CIRCLE_BUILD_URL")
+		}
+	}
+}
+
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		val, ok := env[key]
+		return val, ok
+	}
+}
+
+func TestDetectProvider(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Env      map[string]string
+		Expected string
+	}{
+		{Name: "nothing", Env: map[string]string{}},
+		{Name: "circle", Env: map[string]string{"CIRCLECI": "true", "CIRCLE_BUILD_NUM": "3"}, Expected: providerCircle},
+		{Name: "azure", Env: map[string]string{"TF_BUILD": "True"}, Expected: providerAzurePipelines},
+		{Name: "presence is enough", Env: map[string]string{"CIRCLECI": ""}, Expected: providerCircle},
+		{Name: "wrong value", Env: map[string]string{"CI": "jenkins"}},
+		{Name: "weak evidence only", Env: map[string]string{"BUILD_NUMBER": "3"}},
+		{Name: "jenkins", Env: map[string]string{"JENKINS_URL": "https://ci.example.com/", "BUILD_TAG": "jenkins-app-3"}, Expected: providerJenkins},
+		{Name: "drone", Env: map[string]string{"DRONE": "true", "DRONE_BUILD_NUMBER": "3"}, Expected: providerDrone},
+		{Name: "woodpecker with drone compat", Env: map[string]string{"CI": "woodpecker", "CI_PIPELINE_NUMBER": "3", "DRONE": "true", "DRONE_BUILD_NUMBER": "3"}, Expected: providerWoodpecker},
+		{Name: "harness with drone compat", Env: map[string]string{"HARNESS_BUILD_ID": "3", "HARNESS_PIPELINE_ID": "p", "DRONE": "true", "DRONE_BUILD_NUMBER": "3"}, Expected: providerHarness},
+		{Name: "teamcity", Env: map[string]string{"TEAMCITY_VERSION": "2024.03"}, Expected: providerTeamCity},
+		{Name: "semaphore", Env: map[string]string{"SEMAPHORE": "true"}, Expected: providerSemaphore},
+		{Name: "codebuild", Env: map[string]string{"CODEBUILD_BUILD_ID": "proj:1234"}, Expected: providerCodeBuild},
+		{Name: "appveyor", Env: map[string]string{"APPVEYOR": "True"}, Expected: providerAppVeyor},
+		{Name: "tekton", Env: map[string]string{"TEKTON_PIPELINE_RUN": "build-abc12"}, Expected: providerTekton},
+		{Name: "legacy jenkins-x", Env: map[string]string{"JENKINS-X": ""}, Expected: providerJenkinsX},
+		{Name: "cloud build", Env: map[string]string{"GOOGLE_CLOUD_BUILD": "", "BUILDER_OUTPUT": "/builder/outputs", "PROJECT_ID": "p", "BUILD_ID": "b"}, Expected: providerGoogleCloudBuild},
+		{Name: "cloud build variables alone", Env: map[string]string{"BUILDER_OUTPUT": "/builder/outputs", "PROJECT_ID": "p", "BUILD_ID": "b"}},
+		{Name: "jenkins-x", Env: map[string]string{"JENKINS_X": "", "PIPELINE_KIND": "presubmit", "PULL_BASE_SHA": "abc123", "BUILD_NUMBER": "3"}, Expected: providerJenkinsX},
+		{Name: "jenkins-x variables alone", Env: map[string]string{"PIPELINE_KIND": "presubmit", "PULL_BASE_SHA": "abc123", "BUILD_NUMBER": "3"}},
+		{Name: "highest score wins", Env: map[string]string{"GITHUB_ACTIONS": "true", "BITBUCKET_BUILD_NUMBER": "3", "BITBUCKET_PIPELINE_UUID": "u"}, Expected: providerBitbucketPipelines},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			def := detectProvider(fakeEnv(tc.Env))
+			if tc.Expected == "" {
+				assert.Nil(t, def)
+				return
+			}
+			if assert.NotNil(t, def) {
+				assert.Equal(t, tc.Expected, def.Name)
+			}
+		})
+	}
+}
+
+func TestResolveProvider(t *testing.T) {
+	// providers that were given are kept as they are
+	assert.Equal(t, "circle-ci", resolveProvider("circle-ci"))
+	assert.Equal(t, "gha-buildevents", resolveProvider("gha-buildevents"))
+	assert.Equal(t, "Homegrown-CI", resolveProvider("Homegrown-CI"))
+}
+
+func TestCanonicalProvider(t *testing.T) {
+	assert.Equal(t, providerCircle, canonicalProvider("circle-ci"))
+	assert.Equal(t, providerGitHubActions, canonicalProvider("gha-buildevents"))
+	assert.Equal(t, "Homegrown-CI", canonicalProvider("Homegrown-CI"))
+	assert.Equal(t, "", canonicalProvider(""))
+}
+
+func TestProviderFieldTemplates(t *testing.T) {
+	def := lookupProvider(providerAppVeyor)
+	if !assert.NotNil(t, def) {
+		return
+	}
+	env := map[string]string{
+		"APPVEYOR_REPO_BRANCH":  "main",
+		"APPVEYOR_URL":          "https://ci.appveyor.com",
+		"APPVEYOR_ACCOUNT_NAME": "acme",
+		"APPVEYOR_PROJECT_SLUG": "app",
+		"APPVEYOR_BUILD_ID":     "42",
+	}
+	values := map[string]string{}
+	for _, f := range providerFields(def, fakeEnv(env)) {
+		values[f.name] = f.value
+	}
+	assert.Equal(t, "main", values["branch"])
+	assert.Equal(t, "42", values["build_id"])
+	assert.Equal(t, "https://ci.appveyor.com/project/acme/app/builds/42", values["build_url"])
+
+	// templates are skipped when any variable is missing
+	delete(env, "APPVEYOR_ACCOUNT_NAME")
+	for _, f := range providerFields(def, fakeEnv(env)) {
+		assert.NotEqual(t, "build_url", f.name)
+	}
+}
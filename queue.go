@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// queueConfig holds the options for measuring how long a job waited for a
+// runner
+type queueConfig struct {
+	// enabled looks up the job's queue time from the CI provider's API
+	enabled bool
+	// span also sends a span covering the time the job was queued
+	span        bool
+	circleKey   string
+	githubToken string
+}
+
+// addQueueFlags adds the flags for queueConfig to a command
+func addQueueFlags(cmd *cobra.Command, qcfg *queueConfig) {
+	cmd.Flags().BoolVar(&qcfg.enabled, "queue-time", false, "[env.BUILDEVENT_QUEUE_TIME] look up how long the job waited for a runner from the CircleCI, GitHub Actions or GitLab API and add it as the queued_duration_ms field")
+	if qt, ok := os.LookupEnv("BUILDEVENT_QUEUE_TIME"); ok {
+		cmd.Flags().Lookup("queue-time").Value.Set(qt)
+	}
+
+	cmd.Flags().BoolVar(&qcfg.span, "queued-span", false, "[env.BUILDEVENT_QUEUED_SPAN] also send a \"queued\" span covering the time the job waited for a runner; implies --queue-time")
+	if qs, ok := os.LookupEnv("BUILDEVENT_QUEUED_SPAN"); ok {
+		cmd.Flags().Lookup("queued-span").Value.Set(qs)
+	}
+
+	cmd.Flags().StringVar(&qcfg.circleKey, "circlekey", "", "[env.BUILDEVENT_CIRCLE_API_TOKEN] CircleCI API token used to look up queue times")
+	if tok, ok := os.LookupEnv("BUILDEVENT_CIRCLE_API_TOKEN"); ok {
+		cmd.Flags().Lookup("circlekey").Value.Set(tok)
+	}
+
+	cmd.Flags().StringVar(&qcfg.githubToken, "github-token", "", "[env.GITHUB_TOKEN] GitHub token used to look up queue times, which needs actions:read permission")
+	if tok, ok := os.LookupEnv("GITHUB_TOKEN"); ok {
+		cmd.Flags().Lookup("github-token").Value.Set(tok)
+	}
+}
+
+// queueTimes is when the current job was queued and when a runner picked it up
+type queueTimes struct {
+	queuedAt  time.Time
+	startedAt time.Time
+}
+
+func (q queueTimes) duration() time.Duration {
+	return q.startedAt.Sub(q.queuedAt)
+}
+
+var queueHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// lookupQueueTimes asks the CI provider when the current job was queued and
+// started. The provider may be any of its aliases.
+func lookupQueueTimes(provider string, qcfg *queueConfig, lookupEnv func(string) (string, bool)) (queueTimes, error) {
+	switch canonicalProvider(provider) {
+	case providerCircle:
+		return circleQueueTimes(newCircleClient(qcfg.circleKey), lookupEnv)
+	case providerGitHubActions:
+		return githubQueueTimes(qcfg.githubToken, lookupEnv)
+	case providerGitLab:
+		return gitlabQueueTimes(lookupEnv)
+	}
+	return queueTimes{}, fmt.Errorf("queue times are not available for provider %q", provider)
+}
+
+// circleQueueTimes reads queued_at from the CircleCI job details
+func circleQueueTimes(client *circleClient, lookupEnv func(string) (string, bool)) (queueTimes, error) {
+	user, _ := lookupEnv("CIRCLE_PROJECT_USERNAME")
+	repo, _ := lookupEnv("CIRCLE_PROJECT_REPONAME")
+	num, _ := lookupEnv("CIRCLE_BUILD_NUM")
+	if user == "" || repo == "" || num == "" {
+		return queueTimes{}, fmt.Errorf("CIRCLE_PROJECT_USERNAME, CIRCLE_PROJECT_REPONAME and CIRCLE_BUILD_NUM must be set")
+	}
+	vcs := "gh"
+	if repoURL, _ := lookupEnv("CIRCLE_REPOSITORY_URL"); strings.Contains(repoURL, "bitbucket") {
+		vcs = "bb"
+	}
+
+	job, err := client.getJob(vcs+"/"+user+"/"+repo, num)
+	if err != nil {
+		return queueTimes{}, err
+	}
+	if job.QueuedAt == nil || job.StartedAt == nil {
+		return queueTimes{}, fmt.Errorf("job %s has no queued_at or started_at time", num)
+	}
+	return queueTimes{queuedAt: *job.QueuedAt, startedAt: *job.StartedAt}, nil
+}
+
+// githubJob is the part of a GitHub Actions job we use
+type githubJob struct {
+	Status     string     `json:"status"`
+	RunnerName string     `json:"runner_name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+}
+
+// githubQueueTimes finds the current job in the list of jobs for the run
+// attempt. The environment doesn't tell us the job's ID, so we look for the
+// in progress job on this runner.
+func githubQueueTimes(token string, lookupEnv func(string) (string, bool)) (queueTimes, error) {
+	api, ok := lookupEnv("GITHUB_API_URL")
+	if !ok {
+		api = "https://api.github.com"
+	}
+	repo, _ := lookupEnv("GITHUB_REPOSITORY")
+	runID, _ := lookupEnv("GITHUB_RUN_ID")
+	runner, _ := lookupEnv("RUNNER_NAME")
+	attempt, ok := lookupEnv("GITHUB_RUN_ATTEMPT")
+	if !ok {
+		attempt = "1"
+	}
+	if repo == "" || runID == "" || runner == "" {
+		return queueTimes{}, fmt.Errorf("GITHUB_REPOSITORY, GITHUB_RUN_ID and RUNNER_NAME must be set")
+	}
+
+	headers := map[string]string{"Accept": "application/vnd.github+json"}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	// bound the pages fetched, as with CircleCI jobs
+	for page := 1; page <= maxJobPages; page++ {
+		var resp struct {
+			TotalCount int          `json:"total_count"`
+			Jobs       []*githubJob `json:"jobs"`
+		}
+		u := fmt.Sprintf("%s/repos/%s/actions/runs/%s/attempts/%s/jobs?per_page=100&page=%d",
+			strings.TrimSuffix(api, "/"), repo, url.PathEscape(runID), url.PathEscape(attempt), page)
+		if err := getJSON(u, headers, &resp); err != nil {
+			return queueTimes{}, err
+		}
+		for _, job := range resp.Jobs {
+			if job.RunnerName == runner && job.Status == "in_progress" && job.StartedAt != nil {
+				return queueTimes{queuedAt: job.CreatedAt, startedAt: *job.StartedAt}, nil
+			}
+		}
+		if len(resp.Jobs) == 0 || page*100 >= resp.TotalCount {
+			break
+		}
+	}
+	return queueTimes{}, fmt.Errorf("no job in progress on runner %q in run %s", runner, runID)
+}
+
+// gitlabQueueTimes reads queued_duration from the GitLab job, using the job
+// token to find it.
+func gitlabQueueTimes(lookupEnv func(string) (string, bool)) (queueTimes, error) {
+	api, _ := lookupEnv("CI_API_V4_URL")
+	token, _ := lookupEnv("CI_JOB_TOKEN")
+	if api == "" || token == "" {
+		return queueTimes{}, fmt.Errorf("CI_API_V4_URL and CI_JOB_TOKEN must be set")
+	}
+
+	var job struct {
+		StartedAt *time.Time `json:"started_at"`
+		// QueuedDuration is in seconds
+		QueuedDuration float64 `json:"queued_duration"`
+	}
+	if err := getJSON(strings.TrimSuffix(api, "/")+"/job", map[string]string{"JOB-TOKEN": token}, &job); err != nil {
+		return queueTimes{}, err
+	}
+	if job.StartedAt == nil {
+		return queueTimes{}, fmt.Errorf("job has no started_at time")
+	}
+	queued := time.Duration(job.QueuedDuration * float64(time.Second))
+	return queueTimes{queuedAt: job.StartedAt.Add(-queued), startedAt: *job.StartedAt}, nil
+}
+
+// getJSON fetches the URL and decodes the JSON response body into out
+func getJSON(u string, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := queueHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned status %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// queueInfo looks up how long the job was queued and adds it to the step
+// span. If asked to, it also sends a "queued" span as a child of the step
+// covering the time spent waiting. Problems are reported but don't stop the
+// step span being sent.
+func queueInfo(cfg *libhoney.Config, ecfg *eventConfig, qcfg *queueConfig, provider string, traceID string, stepID string, ev *libhoney.Event) {
+	if !qcfg.enabled && !qcfg.span {
+		return
+	}
+	times, err := lookupQueueTimes(provider, qcfg, os.LookupEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to look up queue time: %v\n", err)
+		return
+	}
+	ev.AddField("queued_duration_ms", times.duration()/time.Millisecond)
+	if !qcfg.span {
+		return
+	}
+
+	queued := newEvent(provider, traceID)
+	queued.Add(map[string]interface{}{
+		"trace.parent_id": stepID,
+		"trace.span_id":   stepID + "-queued",
+		"service_name":    ifClassic(cfg, "queued", cfg.Dataset),
+		"service.name":    ifClassic(cfg, "queued", cfg.Dataset),
+		"command_name":    "queued",
+		"name":            "queued",
+		"duration_ms":     times.duration() / time.Millisecond,
+		"source":          "buildevents",
+	})
+	queued.Timestamp = times.queuedAt
+	sendEvent(ecfg, queued)
+}
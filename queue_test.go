@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircleQueueTimes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/project/gh/org/repo/job/42", r.URL.Path)
+		fmt.Fprint(w, `{"number":42,"queued_at":"2024-03-01T12:00:00Z","started_at":"2024-03-01T12:01:30Z"}`)
+	}))
+	defer server.Close()
+	client := newCircleClient("token")
+	client.baseURL = server.URL + "/api/v2/"
+
+	times, err := circleQueueTimes(client, fakeEnv(map[string]string{
+		"CIRCLE_PROJECT_USERNAME": "org",
+		"CIRCLE_PROJECT_REPONAME": "repo",
+		"CIRCLE_BUILD_NUM":        "42",
+		"CIRCLE_REPOSITORY_URL":   "git@github.com:org/repo.git",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, times.duration())
+
+	_, err = circleQueueTimes(client, fakeEnv(nil))
+	assert.Error(t, err)
+}
+
+func TestGithubQueueTimes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/org/repo/actions/runs/1234/attempts/2/jobs", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("page") == "1" {
+			jobs := ""
+			for i := 0; i < 100; i++ {
+				jobs += fmt.Sprintf(`{"status":"completed","runner_name":"runner-%d","created_at":"2024-03-01T11:00:00Z","started_at":"2024-03-01T11:00:01Z"},`, i)
+			}
+			fmt.Fprintf(w, `{"total_count":101,"jobs":[%s]}`, jobs[:len(jobs)-1])
+			return
+		}
+		fmt.Fprint(w, `{"total_count":101,"jobs":[
+			{"status":"in_progress","runner_name":"runner-7","created_at":"2024-03-01T12:00:00Z","started_at":"2024-03-01T12:00:05Z"}
+		]}`)
+	}))
+	defer server.Close()
+
+	env := map[string]string{
+		"GITHUB_API_URL":     server.URL,
+		"GITHUB_REPOSITORY":  "org/repo",
+		"GITHUB_RUN_ID":      "1234",
+		"GITHUB_RUN_ATTEMPT": "2",
+		"RUNNER_NAME":        "runner-7",
+	}
+	times, err := githubQueueTimes("token", fakeEnv(env))
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, times.duration())
+
+	env["RUNNER_NAME"] = "somewhere-else"
+	_, err = githubQueueTimes("token", fakeEnv(env))
+	assert.Error(t, err)
+}
+
+func TestGitlabQueueTimes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v4/job", r.URL.Path)
+		if r.Header.Get("JOB-TOKEN") != "job-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"401 Unauthorized"}`)
+			return
+		}
+		fmt.Fprint(w, `{"started_at":"2024-03-01T12:00:00.000Z","queued_duration":2.5}`)
+	}))
+	defer server.Close()
+
+	env := map[string]string{
+		"CI_API_V4_URL": server.URL + "/api/v4",
+		"CI_JOB_TOKEN":  "job-token",
+	}
+	times, err := gitlabQueueTimes(fakeEnv(env))
+	require.NoError(t, err)
+	assert.Equal(t, 2500*time.Millisecond, times.duration())
+	assert.Equal(t, time.Date(2024, 3, 1, 11, 59, 57, 500000000, time.UTC), times.queuedAt.UTC())
+
+	// the provider may be given by an alias
+	times, err = lookupQueueTimes("gitlab", &queueConfig{}, fakeEnv(env))
+	require.NoError(t, err)
+	assert.Equal(t, 2500*time.Millisecond, times.duration())
+
+	env["CI_JOB_TOKEN"] = "wrong"
+	_, err = gitlabQueueTimes(fakeEnv(env))
+	assert.ErrorContains(t, err, "status 401")
+}
+
+func TestLookupQueueTimesUnsupported(t *testing.T) {
+	_, err := lookupQueueTimes(providerTravis, &queueConfig{}, fakeEnv(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// semconvField maps one of our field names to an OpenTelemetry semantic
+// convention attribute.
+type semconvField struct {
+	field string
+	attr  string
+}
+
+// semconvFields lists the OpenTelemetry CICD and VCS semantic convention
+// attributes we can derive from the fields providers add. When several fields
+// map to the same attribute, the first one present wins, so more specific
+// fields are listed first.
+var semconvFields = []semconvField{
+	{"workflow_name", "cicd.pipeline.name"},
+	{"build_num", "cicd.pipeline.run.id"},
+	{"build_id", "cicd.pipeline.run.id"},
+	{"pipeline_id", "cicd.pipeline.run.id"},
+	{"build_url", "cicd.pipeline.run.url.full"},
+	{"job_name", "cicd.pipeline.task.name"},
+
+	// for a pull request, the head is the branch being merged in
+	{"pr_branch", "vcs.ref.head.name"},
+	{"branch", "vcs.ref.head.name"},
+	{"pr_target_branch", "vcs.ref.base.name"},
+	{"commit", "vcs.ref.head.revision"},
+	{"pr_number", "vcs.change.id"},
+	{"pr_id", "vcs.change.id"},
+	{"pr_title", "vcs.change.title"},
+}
+
+// addSemconvFields adds OpenTelemetry semantic convention attributes to the
+// event based on the fields already on it, so that every CI provider can be
+// queried the same way. The original fields are left in place.
+func addSemconvFields(ev *libhoney.Event) {
+	fields := ev.Fields()
+	attrs := map[string]interface{}{}
+	for _, sf := range semconvFields {
+		if _, ok := attrs[sf.attr]; ok {
+			continue
+		}
+		val, ok := semconvValue(fields[sf.field])
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(sf.attr, "vcs.ref.") && strings.HasSuffix(sf.attr, ".name") {
+			val = trimRefPrefix(val)
+		}
+		attrs[sf.attr] = val
+	}
+
+	// the repo field is a URL for some providers and owner/name for others
+	if repo, ok := semconvValue(fields["repo"]); ok {
+		if strings.Contains(repo, "://") || strings.HasPrefix(repo, "git@") {
+			attrs["vcs.repository.url.full"] = repo
+		} else {
+			attrs["vcs.repository.name"] = repo
+		}
+	}
+
+	ev.Add(attrs)
+}
+
+// semconvValue returns the field as a string, skipping the empty and "false"
+// placeholder values some providers set when there's no pull request.
+func semconvValue(v interface{}) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	s := strings.TrimSpace(fmt.Sprint(v))
+	if s == "" || s == "false" {
+		return "", false
+	}
+	return s, true
+}
+
+// trimRefPrefix turns a full git ref like refs/heads/main in to the branch or
+// tag name.
+func trimRefPrefix(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+func TestAddSemconvFields(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Fields   map[string]interface{}
+		Expected map[string]interface{}
+	}{
+		{
+			Name:   "github push",
+			Fields: map[string]interface{}{"branch": "refs/heads/main", "build_num": "99", "pr_branch": "", "repo": "org/repo", "workflow_name": "CI"},
+			Expected: map[string]interface{}{
+				"cicd.pipeline.name":   "CI",
+				"cicd.pipeline.run.id": "99",
+				"vcs.ref.head.name":    "main",
+				"vcs.repository.name":  "org/repo",
+			},
+		},
+		{
+			Name:   "travis pull request",
+			Fields: map[string]interface{}{"branch": "main", "pr_branch": "feature", "pr_number": "12", "repo": "org/repo"},
+			Expected: map[string]interface{}{
+				"vcs.ref.head.name":   "feature",
+				"vcs.change.id":       "12",
+				"vcs.repository.name": "org/repo",
+			},
+		},
+		{
+			Name:   "travis push",
+			Fields: map[string]interface{}{"branch": "main", "pr_number": "false"},
+			Expected: map[string]interface{}{
+				"vcs.ref.head.name": "main",
+			},
+		},
+		{
+			Name:   "azure",
+			Fields: map[string]interface{}{"build_id": "1234", "build_number": "20240301.1", "repo": "https://dev.azure.com/org/proj/_git/repo", "pr_id": "7"},
+			Expected: map[string]interface{}{
+				"cicd.pipeline.run.id":    "1234",
+				"vcs.change.id":           "7",
+				"vcs.repository.url.full": "https://dev.azure.com/org/proj/_git/repo",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ev := libhoney.NewEvent()
+			ev.Add(tc.Fields)
+			addSemconvFields(ev)
+
+			got := map[string]interface{}{}
+			for k, v := range ev.Fields() {
+				if _, orig := tc.Fields[k]; !orig {
+					got[k] = v
+				}
+			}
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
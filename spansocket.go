@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spanConnTimeout bounds how long we wait for a message on a connection to
+// the span socket
+const spanConnTimeout = 5 * time.Second
+
+// spanMessage is what a wrapped command sends to the span socket, one JSON
+// object per connection.
+type spanMessage struct {
+	// Type is start, finish or span. A start message opens a span that a
+	// finish message with the same ID closes and sends; a span message sends
+	// a span that has already finished.
+	Type string `json:"type"`
+	// ID identifies the span to later messages. It's not the span ID sent to
+	// Honeycomb, which is generated for it.
+	ID string `json:"id"`
+	// ParentID is the ID of another span sent through the socket to nest
+	// this one under. By default, spans are children of the cmd span.
+	ParentID string `json:"parent_id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	// Time is when the span started (for start and span messages) or
+	// finished (for finish messages) in seconds since the epoch. It defaults
+	// to when the message arrives.
+	Time float64 `json:"time"`
+	// DurationMs is how long a span sent with a span message took
+	DurationMs float64 `json:"duration_ms"`
+	// Fields are added to the span, apart from the reserved ones
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// reservedSpanFields are set by buildevents on the spans sent through the
+// socket, so a message's fields may not change them. Neither may they set
+// fields starting with "trace." or "meta.".
+var reservedSpanFields = map[string]bool{
+	"service_name": true,
+	"service.name": true,
+	"command_name": true,
+	"source":       true,
+	"name":         true,
+	"status":       true,
+	"duration_ms":  true,
+	"ci_provider":  true,
+}
+
+// addSpanFields copies a message's fields in to a span's, skipping the
+// reserved ones
+func addSpanFields(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if reservedSpanFields[k] || strings.HasPrefix(k, "trace.") || strings.HasPrefix(k, "meta.") {
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// openSpan is a span that has been started but not finished
+type openSpan struct {
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	fields   map[string]interface{}
+}
+
+// spanServer listens on a Unix domain socket for spans sent by a wrapped
+// command and sends them as children of the command's span.
+type spanServer struct {
+	dir      string
+	listener net.Listener
+	// parentID is the span ID of the cmd span
+	parentID string
+	// send sends a finished span
+	send func(fields map[string]interface{}, start time.Time)
+	// now is the clock, replaceable for tests
+	now func() time.Time
+
+	mu sync.Mutex
+	// spanIDs maps the IDs used in messages to the span IDs we generated
+	spanIDs map[string]string
+	open    map[string]*openSpan
+	conns   sync.WaitGroup
+	// done is closed when serve stops accepting connections, after which
+	// no more are added to conns
+	done chan struct{}
+}
+
+// newSpanServer starts listening on a socket in a new temporary directory
+func newSpanServer(parentID string, send func(map[string]interface{}, time.Time)) (*spanServer, error) {
+	dir, err := os.MkdirTemp("", "buildevents-")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "span.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &spanServer{
+		dir:      dir,
+		listener: listener,
+		parentID: parentID,
+		send:     send,
+		now:      time.Now,
+		spanIDs:  map[string]string{},
+		open:     map[string]*openSpan{},
+		done:     make(chan struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// path is where the socket is
+func (s *spanServer) path() string {
+	return s.listener.Addr().String()
+}
+
+func (s *spanServer) serve() {
+	defer close(s.done)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// the listener was closed
+			return
+		}
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// handleConn reads a single message, replies with "ok" or the error, then
+// closes the connection. Closing it ourselves means tools like nc exit
+// whether or not they shut down their side of the connection.
+func (s *spanServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(spanConnTimeout))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return
+	}
+	var msg spanMessage
+	if err = json.Unmarshal(line, &msg); err == nil {
+		err = s.handle(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintln(conn, "ok")
+}
+
+// handle acts on a message
+func (s *spanServer) handle(msg spanMessage) error {
+	at := s.now()
+	if msg.Time > 0 {
+		sec, frac := math.Modf(msg.Time)
+		at = time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch msg.Type {
+	case "start":
+		if msg.ID == "" || msg.Name == "" {
+			return errors.New("start messages need an id and a name")
+		}
+		if _, ok := s.spanIDs[msg.ID]; ok {
+			return fmt.Errorf("span %q has already been started", msg.ID)
+		}
+		span, err := s.newSpan(msg, at)
+		if err != nil {
+			return err
+		}
+		s.open[msg.ID] = span
+		return nil
+
+	case "finish":
+		span, ok := s.open[msg.ID]
+		if !ok {
+			return fmt.Errorf("span %q has not been started", msg.ID)
+		}
+		delete(s.open, msg.ID)
+		addSpanFields(span.fields, msg.Fields)
+		status := msg.Status
+		if status == "" {
+			status = "success"
+		}
+		s.sendSpan(span, at, status)
+		return nil
+
+	case "span":
+		if msg.Name == "" {
+			return errors.New("span messages need a name")
+		}
+		if msg.ID != "" {
+			if _, ok := s.spanIDs[msg.ID]; ok {
+				return fmt.Errorf("span %q has already been started", msg.ID)
+			}
+		}
+		dur := time.Duration(msg.DurationMs * float64(time.Millisecond))
+		start := at
+		if msg.Time <= 0 {
+			// it has just finished
+			start = at.Add(-dur)
+		}
+		span, err := s.newSpan(msg, start)
+		if err != nil {
+			return err
+		}
+		status := msg.Status
+		if status == "" {
+			status = "success"
+		}
+		s.sendSpan(span, start.Add(dur), status)
+		return nil
+	}
+	return fmt.Errorf("unknown message type %q, expected start, finish or span", msg.Type)
+}
+
+// newSpan creates a span for a message, recording its ID. It must be called
+// with the lock held.
+func (s *spanServer) newSpan(msg spanMessage, start time.Time) (*openSpan, error) {
+	parentID := s.parentID
+	if msg.ParentID != "" {
+		id, ok := s.spanIDs[msg.ParentID]
+		if !ok {
+			return nil, fmt.Errorf("parent span %q has not been started", msg.ParentID)
+		}
+		parentID = id
+	}
+	spanBytes := make([]byte, 16)
+	rand.Read(spanBytes)
+	span := &openSpan{
+		spanID:   fmt.Sprintf("%x", spanBytes),
+		parentID: parentID,
+		name:     msg.Name,
+		start:    start,
+		fields:   map[string]interface{}{},
+	}
+	addSpanFields(span.fields, msg.Fields)
+	if msg.ID != "" {
+		s.spanIDs[msg.ID] = span.spanID
+	}
+	return span, nil
+}
+
+func (s *spanServer) sendSpan(span *openSpan, end time.Time, status string) {
+	fields := map[string]interface{}{}
+	for k, v := range span.fields {
+		fields[k] = v
+	}
+	fields["trace.parent_id"] = span.parentID
+	fields["trace.span_id"] = span.spanID
+	fields["name"] = span.name
+	fields["status"] = status
+	fields["duration_ms"] = end.Sub(span.start) / time.Millisecond
+	s.send(fields, span.start)
+}
+
+// close stops listening, waits for any connections in progress, and sends
+// the spans that were started but never finished with a status of
+// "unfinished".
+func (s *spanServer) close() {
+	s.listener.Close()
+	// wait for serve to return first, so it can't add a connection while
+	// we're waiting for the others
+	<-s.done
+	s.conns.Wait()
+	defer os.RemoveAll(s.dir)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.open))
+	for id := range s.open {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	end := s.now()
+	for _, id := range ids {
+		s.sendSpan(s.open[id], end, "unfinished")
+	}
+	s.open = map[string]*openSpan{}
+}
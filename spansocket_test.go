@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sentSpan is a span sent by a spanServer under test
+type sentSpan struct {
+	fields map[string]interface{}
+	start  time.Time
+}
+
+func newTestSpanServer(t *testing.T) (*spanServer, func() []sentSpan) {
+	var mu sync.Mutex
+	var sent []sentSpan
+	s, err := newSpanServer("cmd-span", func(fields map[string]interface{}, start time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, sentSpan{fields, start})
+	})
+	require.NoError(t, err)
+	return s, func() []sentSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sentSpan(nil), sent...)
+	}
+}
+
+// sendSpanMessage sends a message to the socket and returns the reply
+func sendSpanMessage(t *testing.T, s *spanServer, msg string) string {
+	conn, err := net.Dial("unix", s.path())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(msg + "\n"))
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return reply
+}
+
+func TestSpanServer(t *testing.T) {
+	s, sent := newTestSpanServer(t)
+
+	assert.Equal(t, "ok\n", sendSpanMessage(t, s, `{"type":"start","id":"build","name":"compile","fields":{"target":"linux"}}`))
+	assert.Equal(t, "ok\n", sendSpanMessage(t, s, `{"type":"span","parent_id":"build","name":"codegen","time":1700000000.5,"duration_ms":1500}`))
+	assert.Equal(t, "ok\n", sendSpanMessage(t, s, `{"type":"finish","id":"build","status":"failure","fields":{"warnings":3}}`))
+	assert.Equal(t, "ok\n", sendSpanMessage(t, s, `{"type":"start","id":"forgotten","name":"download deps"}`))
+
+	assert.Equal(t, "error: span \"nope\" has not been started\n", sendSpanMessage(t, s, `{"type":"finish","id":"nope"}`))
+	assert.Equal(t, "error: span \"build\" has already been started\n", sendSpanMessage(t, s, `{"type":"start","id":"build","name":"again"}`))
+	assert.Contains(t, sendSpanMessage(t, s, `{"type":"bogus"}`), "unknown message type")
+	assert.Contains(t, sendSpanMessage(t, s, `not json`), "error:")
+
+	s.close()
+	spans := sent()
+	require.Len(t, spans, 3)
+
+	codegen, compile, forgotten := spans[0], spans[1], spans[2]
+	assert.Equal(t, "codegen", codegen.fields["name"])
+	assert.Equal(t, compile.fields["trace.span_id"], codegen.fields["trace.parent_id"])
+	assert.Equal(t, time.Duration(1500), codegen.fields["duration_ms"])
+	assert.Equal(t, time.Unix(1700000000, 500000000), codegen.start)
+
+	assert.Equal(t, "compile", compile.fields["name"])
+	assert.Equal(t, "cmd-span", compile.fields["trace.parent_id"])
+	assert.Equal(t, "failure", compile.fields["status"])
+	assert.Equal(t, "linux", compile.fields["target"])
+	assert.Equal(t, float64(3), compile.fields["warnings"])
+
+	assert.Equal(t, "download deps", forgotten.fields["name"])
+	assert.Equal(t, "unfinished", forgotten.fields["status"])
+
+	// the socket is gone once the server is closed
+	_, err := net.Dial("unix", s.path())
+	assert.Error(t, err)
+}
+
+func TestSpanServerReservedFields(t *testing.T) {
+	s, sent := newTestSpanServer(t)
+
+	assert.Equal(t, "ok\n", sendSpanMessage(t, s, `{"type":"start","id":"a","name":"lint","fields":{"trace.trace_id":"other","service.name":"x","meta.version":"0"}}`))
+	assert.Equal(t, "ok\n", sendSpanMessage(t, s, `{"type":"finish","id":"a","fields":{"trace.parent_id":"elsewhere","name":"renamed","status":"failure","duration_ms":1,"source":"me","files":12}}`))
+	s.close()
+
+	spans := sent()
+	require.Len(t, spans, 1)
+	fields := spans[0].fields
+	assert.Equal(t, "cmd-span", fields["trace.parent_id"])
+	assert.Equal(t, "lint", fields["name"])
+	assert.Equal(t, "success", fields["status"])
+	assert.Equal(t, 12.0, fields["files"])
+	for _, key := range []string{"trace.trace_id", "service.name", "meta.version", "source"} {
+		assert.NotContains(t, fields, key)
+	}
+	assert.IsType(t, time.Duration(0), fields["duration_ms"])
+}